@@ -0,0 +1,156 @@
+package chord
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// nodeCache is a bounded cache of remote vnodes learned from lookups.
+// Entries are kept sorted by ID so that the nearest node to a key can be
+// found with a binary search. Once the cache is full the least recently
+// used entry is evicted, and entries older than the TTL are dropped.
+type nodeCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	clock   Clock
+	entries []*cacheEntry // Sorted by vnode ID
+	lru     *list.List    // Front is the most recently used
+}
+
+// A single cached vnode
+type cacheEntry struct {
+	vn    *Vnode
+	added time.Time
+	elem  *list.Element
+}
+
+// Creates a new node cache holding at most size entries. A size of
+// zero or less means unbounded, a ttl of zero disables expiry. Entry ages
+// are measured on the given clock.
+func newNodeCache(size int, ttl time.Duration, clock Clock) *nodeCache {
+	return &nodeCache{
+		size:    size,
+		ttl:     ttl,
+		clock:   clock,
+		entries: make([]*cacheEntry, 0),
+		lru:     list.New(),
+	}
+}
+
+// Returns the number of cached vnodes
+func (c *nodeCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Adds or refreshes a vnode in the cache
+func (c *nodeCache) add(vn *Vnode) {
+	if vn == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Refresh an existing entry
+	idx, found := c.search(vn.Id)
+	if found {
+		e := c.entries[idx]
+		e.vn = vn
+		e.added = c.clock.Now()
+		c.lru.MoveToFront(e.elem)
+		return
+	}
+
+	// Insert keeping the entries sorted
+	e := &cacheEntry{vn: vn, added: c.clock.Now()}
+	e.elem = c.lru.PushFront(e)
+	c.entries = append(c.entries, nil)
+	copy(c.entries[idx+1:], c.entries[idx:])
+	c.entries[idx] = e
+
+	// Evict the least recently used entries
+	for c.size > 0 && len(c.entries) > c.size {
+		c.removeEntry(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// Removes a vnode from the cache, used when it fails to respond
+func (c *nodeCache) remove(vn *Vnode) {
+	if vn == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if idx, found := c.search(vn.Id); found {
+		c.removeEntry(c.entries[idx])
+	}
+}
+
+// Returns the cached vnode nearest to the key, that is the vnode with
+// the largest ID less than the key, wrapping around the ring. Returns
+// nil if the cache is empty.
+func (c *nodeCache) nearest(key []byte) *Vnode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.entries) > 0 {
+		// Find the first entry >= key, the one before is the nearest
+		idx, _ := c.search(key)
+		idx--
+		if idx < 0 {
+			idx = len(c.entries) - 1
+		}
+		e := c.entries[idx]
+
+		// Drop expired entries and try again
+		if c.ttl > 0 && c.clock.Now().Sub(e.added) > c.ttl {
+			c.removeEntry(e)
+			continue
+		}
+		c.lru.MoveToFront(e.elem)
+		return e.vn
+	}
+	return nil
+}
+
+// Returns the cached vnodes that have not expired, most recently used first
+func (c *nodeCache) vnodes() []*Vnode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res := make([]*Vnode, 0, len(c.entries))
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*cacheEntry)
+		if c.ttl > 0 && c.clock.Now().Sub(e.added) > c.ttl {
+			continue
+		}
+		res = append(res, e.vn)
+	}
+	return res
+}
+
+// Finds the index of the first entry with an ID >= id, and whether
+// that entry is an exact match. Must be called with the lock held.
+func (c *nodeCache) search(id []byte) (int, bool) {
+	idx := sort.Search(len(c.entries), func(i int) bool {
+		return bytes.Compare(c.entries[i].vn.Id, id) >= 0
+	})
+	found := idx < len(c.entries) && bytes.Equal(c.entries[idx].vn.Id, id)
+	return idx, found
+}
+
+// Removes an entry. Must be called with the lock held.
+func (c *nodeCache) removeEntry(e *cacheEntry) {
+	idx, found := c.search(e.vn.Id)
+	if !found {
+		return
+	}
+	c.lru.Remove(e.elem)
+	copy(c.entries[idx:], c.entries[idx+1:])
+	c.entries[len(c.entries)-1] = nil
+	c.entries = c.entries[:len(c.entries)-1]
+}
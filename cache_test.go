@@ -0,0 +1,126 @@
+package chord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeCacheAdd(t *testing.T) {
+	c := newNodeCache(0, 0, wallClock{})
+	c.add(&Vnode{Id: []byte{30}})
+	c.add(&Vnode{Id: []byte{10}})
+	c.add(&Vnode{Id: []byte{20}})
+	c.add(&Vnode{Id: []byte{10}})
+	c.add(nil)
+
+	if c.Len() != 3 {
+		t.Fatalf("bad len %d", c.Len())
+	}
+	for i := 0; i < 3; i++ {
+		if c.entries[i].vn.Id[0] != byte(10*(i+1)) {
+			t.Fatalf("entries not sorted!")
+		}
+	}
+}
+
+func TestNodeCacheNearest(t *testing.T) {
+	c := newNodeCache(0, 0, wallClock{})
+	if c.nearest([]byte{5}) != nil {
+		t.Fatalf("expected nil")
+	}
+
+	c.add(&Vnode{Id: []byte{10}})
+	c.add(&Vnode{Id: []byte{20}})
+	c.add(&Vnode{Id: []byte{30}})
+
+	if n := c.nearest([]byte{25}); n.Id[0] != 20 {
+		t.Fatalf("bad nearest %s", n)
+	}
+	if n := c.nearest([]byte{20}); n.Id[0] != 10 {
+		t.Fatalf("bad nearest %s", n)
+	}
+
+	// Wraps around the ring
+	if n := c.nearest([]byte{5}); n.Id[0] != 30 {
+		t.Fatalf("bad nearest %s", n)
+	}
+}
+
+func TestNodeCacheRemove(t *testing.T) {
+	c := newNodeCache(0, 0, wallClock{})
+	c.add(&Vnode{Id: []byte{10}})
+	c.add(&Vnode{Id: []byte{20}})
+
+	c.remove(&Vnode{Id: []byte{20}})
+	c.remove(&Vnode{Id: []byte{40}})
+	if c.Len() != 1 {
+		t.Fatalf("bad len %d", c.Len())
+	}
+	if n := c.nearest([]byte{25}); n.Id[0] != 10 {
+		t.Fatalf("bad nearest %s", n)
+	}
+	if c.lru.Len() != 1 {
+		t.Fatalf("lru out of sync")
+	}
+}
+
+func TestNodeCacheEvictLRU(t *testing.T) {
+	c := newNodeCache(2, 0, wallClock{})
+	c.add(&Vnode{Id: []byte{10}})
+	c.add(&Vnode{Id: []byte{20}})
+
+	// Touch 10, making 20 the least recently used
+	c.nearest([]byte{15})
+	c.add(&Vnode{Id: []byte{30}})
+
+	if c.Len() != 2 {
+		t.Fatalf("bad len %d", c.Len())
+	}
+	if _, found := c.search([]byte{20}); found {
+		t.Fatalf("expected 20 to be evicted")
+	}
+	if _, found := c.search([]byte{10}); !found {
+		t.Fatalf("expected 10 to be kept")
+	}
+}
+
+func TestNodeCacheExpire(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	c := newNodeCache(0, time.Minute, clock)
+	c.add(&Vnode{Id: []byte{10}})
+	c.add(&Vnode{Id: []byte{20}})
+
+	// Entries live up to the TTL
+	clock.Advance(time.Minute)
+	if n := c.nearest([]byte{25}); n == nil || n.Id[0] != 20 {
+		t.Fatalf("expected live entry, got %v", n)
+	}
+
+	clock.Advance(time.Second)
+	if n := c.nearest([]byte{25}); n != nil {
+		t.Fatalf("expected expired entries, got %s", n)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("bad len %d", c.Len())
+	}
+}
+
+func TestVnodeFindSuccessorsCacheInvalidate(t *testing.T) {
+	vn := makeVnode()
+	vn.init(0)
+	vn.Id = []byte{1}
+	vn.successors[0] = &Vnode{Id: []byte{2}}
+	vn.nodeCache = newNodeCache(0, 0, wallClock{})
+
+	// Cache a dead node just before the key
+	dead := &Vnode{Id: []byte{0xfe}}
+	vn.nodeCache.add(dead)
+
+	res := vn.findSuccessorsCache(1, []byte{0xff}, NewLookupMetaData())
+	if res.Err == nil {
+		t.Fatalf("expected err!")
+	}
+	if vn.nodeCache.Len() != 0 {
+		t.Fatalf("expected dead node to be invalidated")
+	}
+}
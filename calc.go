@@ -0,0 +1,197 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// RingLayout is the ring that the given members would converge to,
+// computed offline without any network or timers. It gives the ideal
+// state of each vnode, for capacity planning or to compare against a live
+// ring.
+type RingLayout struct {
+	Vnodes        []*Vnode // Sorted by ID
+	numSuccessors int
+	hashBits      int
+	hashFunc      func() hash.Hash
+}
+
+// Computes the ring formed by the given members, using the NumVnodes,
+// NumSuccessors and HashFunc of the config. Hosts and node names must be
+// unique.
+func ComputeRing(conf *Config, members []RingMember) (*RingLayout, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("Need at least one host!")
+	}
+	if conf.NumVnodes < 1 {
+		return nil, fmt.Errorf("Need at least one vnode per host!")
+	}
+	hashBits := conf.HashFunc().Size() * 8
+	if hashBits > MaxIDBits {
+		return nil, fmt.Errorf("Hash function is too wide! Got %d bits, max is %d", hashBits, MaxIDBits)
+	}
+	vnodes, err := ComputeVnodes(conf, members)
+	if err != nil {
+		return nil, err
+	}
+	return &RingLayout{
+		Vnodes:        vnodes,
+		numSuccessors: conf.NumSuccessors,
+		hashBits:      hashBits,
+		hashFunc:      conf.HashFunc,
+	}, nil
+}
+
+// Returns the index of the first vnode at or after an ID
+func (l *RingLayout) successorIndex(id []byte) int {
+	idx := sort.Search(len(l.Vnodes), func(i int) bool {
+		return bytes.Compare(l.Vnodes[i].Id, id) >= 0
+	})
+	return idx % len(l.Vnodes)
+}
+
+// Returns the index of a vnode of the ring, or -1
+func (l *RingLayout) index(vn *Vnode) int {
+	idx := l.successorIndex(vn.Id)
+	if !bytes.Equal(l.Vnodes[idx].Id, vn.Id) {
+		return -1
+	}
+	return idx
+}
+
+// Returns the vnode owning an ID, the first one at or after it
+func (l *RingLayout) Owner(id []byte) *Vnode {
+	return l.Vnodes[l.successorIndex(id)]
+}
+
+// Returns the vnode owning a key
+func (l *RingLayout) Lookup(key []byte) *Vnode {
+	h := l.hashFunc()
+	h.Write(key)
+	return l.Owner(h.Sum(nil))
+}
+
+// Returns the predecessor of a vnode, nil if it is not in the ring
+func (l *RingLayout) Predecessor(vn *Vnode) *Vnode {
+	idx := l.index(vn)
+	if idx < 0 {
+		return nil
+	}
+	return l.Vnodes[(idx+len(l.Vnodes)-1)%len(l.Vnodes)]
+}
+
+// Returns the successor list of a vnode: the next NumSuccessors vnodes,
+// fewer on small rings. Nil if the vnode is not in the ring.
+func (l *RingLayout) Successors(vn *Vnode) []*Vnode {
+	idx := l.index(vn)
+	if idx < 0 {
+		return nil
+	}
+	n := min(l.numSuccessors, len(l.Vnodes)-1)
+	succs := make([]*Vnode, n)
+	for i := range succs {
+		succs[i] = l.Vnodes[(idx+1+i)%len(l.Vnodes)]
+	}
+	return succs
+}
+
+// Returns the finger table of a vnode: entry k is the owner of the ID
+// 2^k after it. Nil if the vnode is not in the ring.
+func (l *RingLayout) Fingers(vn *Vnode) []*Vnode {
+	if l.index(vn) < 0 {
+		return nil
+	}
+	fingers := make([]*Vnode, l.hashBits)
+	for k := range fingers {
+		fingers[k] = l.Owner(powerOffset(vn.Id, k, l.hashBits))
+	}
+	return fingers
+}
+
+// Returns the range owned by each vnode, sorted by owner ID
+func (l *RingLayout) Ranges() []OwnedRange {
+	ranges := make([]OwnedRange, len(l.Vnodes))
+	for idx, vn := range l.Vnodes {
+		ranges[idx] = OwnedRange{Owner: vn, Predecessor: l.Vnodes[(idx+len(l.Vnodes)-1)%len(l.Vnodes)]}
+	}
+	return ranges
+}
+
+// Returns the ranges owned by the vnodes of each host
+func (l *RingLayout) HostRanges() map[string][]OwnedRange {
+	byHost := make(map[string][]OwnedRange)
+	for _, r := range l.Ranges() {
+		byHost[r.Owner.Host] = append(byHost[r.Owner.Host], r)
+	}
+	return byHost
+}
+
+// Reports how the ring spreads the hash space and the sample keys
+func (l *RingLayout) Load(keys [][]byte) *LoadReport {
+	return AnalyzeLoad(l.Vnodes, l.hashFunc, keys)
+}
+
+// A range of the hash space, (Start, End], changing owner between two
+// rings
+type RangeMove struct {
+	Start []byte  // Exclusive
+	End   []byte  // Inclusive, equal to Start for the whole ring
+	From  *Vnode  // Owner before the change
+	To    *Vnode  // Owner after the change
+	Space float64 // Fraction of the hash space moving
+}
+
+// Returns the ranges whose owner differs between two versions of a ring,
+// for instance before and after adding or removing hosts. Adjacent ranges
+// moving between the same vnodes are merged. Both rings must use the
+// same hash function.
+func DiffRings(before, after *RingLayout) []RangeMove {
+	// Ownership can only change at the vnode IDs of either ring
+	var bounds [][]byte
+	seen := make(map[string]bool)
+	for _, vns := range [][]*Vnode{before.Vnodes, after.Vnodes} {
+		for _, vn := range vns {
+			if id := vn.idKey(); !seen[id] {
+				seen[id] = true
+				bounds = append(bounds, vn.Id)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return bytes.Compare(bounds[i], bounds[j]) < 0
+	})
+
+	// Each range between two bounds has a single owner in each ring
+	var moves []RangeMove
+	for i, end := range bounds {
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		from, to := before.Owner(end), after.Owner(end)
+		if sameVnode(from, to) {
+			continue
+		}
+		if n := len(moves); n > 0 && bytes.Equal(moves[n-1].End, start) &&
+			sameVnode(moves[n-1].From, from) && sameVnode(moves[n-1].To, to) {
+			moves[n-1].End = end
+			continue
+		}
+		moves = append(moves, RangeMove{Start: start, End: end, From: from, To: to})
+	}
+
+	// Join the last and first ranges across the wrap around
+	if n := len(moves); n > 1 && bytes.Equal(moves[n-1].End, moves[0].Start) &&
+		sameVnode(moves[n-1].From, moves[0].From) && sameVnode(moves[n-1].To, moves[0].To) {
+		moves[0].Start = moves[n-1].Start
+		moves = moves[:n-1]
+	}
+
+	for i := range moves {
+		m := &moves[i]
+		m.Space = 1
+		if !bytes.Equal(m.Start, m.End) {
+			m.Space = idFraction(distance(m.Start, m.End, before.hashBits), before.hashBits)
+		}
+	}
+	return moves
+}
@@ -0,0 +1,138 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Returns the given number of members named after their hosts
+func makeHosts(n int) []RingMember {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host-%d", i)
+	}
+	return HostMembers(hosts)
+}
+
+func TestComputeRing(t *testing.T) {
+	if _, err := ComputeRing(DefaultConfig(""), nil); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if _, err := ComputeRing(DefaultConfig(""), HostMembers([]string{"a", "a"})); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	conf := DefaultConfig("")
+	l, err := ComputeRing(conf, makeHosts(5))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	num := len(l.Vnodes)
+	if num != 5*conf.NumVnodes {
+		t.Fatalf("bad vnode count %d", num)
+	}
+
+	// The computed state is a correct ring
+	var states []*vnodeState
+	for _, vn := range l.Vnodes {
+		succs := l.Successors(vn)
+		if len(succs) != conf.NumSuccessors {
+			t.Fatalf("bad successors %v", succs)
+		}
+		states = append(states, &vnodeState{
+			vn:          vn,
+			predecessor: l.Predecessor(vn),
+			successors:  succs,
+			finger:      l.Fingers(vn),
+		})
+	}
+	if v := checkStates(states, 160); len(v) != 0 {
+		t.Fatalf("unexpected violations %v", v)
+	}
+
+	// Unknown vnodes have no state
+	if l.Successors(&Vnode{Id: []byte{1}}) != nil || l.Predecessor(&Vnode{Id: []byte{1}}) != nil {
+		t.Fatalf("expected no state")
+	}
+
+	// Each key belongs to the range of its owner
+	owner := l.Lookup([]byte("test"))
+	h := conf.HashFunc()
+	h.Write([]byte("test"))
+	for _, r := range l.HostRanges()[owner.Host] {
+		if r.Contains(h.Sum(nil)) != bytes.Equal(r.Owner.Id, owner.Id) {
+			t.Fatalf("bad range %v", r)
+		}
+	}
+	if space := l.Load(nil).HostSpace.Mean * 5; math.Abs(space-1) > 1e-9 {
+		t.Fatalf("bad space %v", space)
+	}
+}
+
+func TestComputeRingSmall(t *testing.T) {
+	conf := DefaultConfig("")
+	conf.NumVnodes = 1
+	l, err := ComputeRing(conf, makeHosts(1))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vn := l.Vnodes[0]
+	if len(l.Successors(vn)) != 0 || l.Predecessor(vn) != vn {
+		t.Fatalf("bad state of a lone vnode")
+	}
+	if r := l.Ranges()[0]; !r.Contains([]byte("anything")) {
+		t.Fatalf("lone vnode should own everything")
+	}
+}
+
+func TestDiffRings(t *testing.T) {
+	conf := DefaultConfig("")
+	before, _ := ComputeRing(conf, makeHosts(10))
+	after, _ := ComputeRing(conf, makeHosts(11))
+	if moves := DiffRings(before, before); len(moves) != 0 {
+		t.Fatalf("unexpected moves %v", moves)
+	}
+
+	// Adding a host moves exactly the ranges it owns to it
+	moves := DiffRings(before, after)
+	if len(moves) == 0 {
+		t.Fatalf("expected moves")
+	}
+	moved := 0.0
+	for _, m := range moves {
+		if m.To.Host != "host-10" || m.From.Host == "host-10" {
+			t.Fatalf("bad move %+v", m)
+		}
+		moved += m.Space
+	}
+	owned := 0.0
+	for _, hl := range after.Load(nil).Hosts {
+		if hl.Host == "host-10" {
+			owned = hl.Space
+		}
+	}
+	if math.Abs(moved-owned) > 1e-9 {
+		t.Fatalf("moved %v, new host owns %v", moved, owned)
+	}
+
+	// Removing it moves them back
+	for _, m := range DiffRings(after, before) {
+		if m.From.Host != "host-10" {
+			t.Fatalf("bad move %+v", m)
+		}
+	}
+
+	// Replacing the only host moves the whole ring
+	conf.NumVnodes = 1
+	a, _ := ComputeRing(conf, HostMembers([]string{"a"}))
+	b, _ := ComputeRing(conf, HostMembers([]string{"b"}))
+	total := 0.0
+	for _, m := range DiffRings(a, b) {
+		total += m.Space
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Fatalf("bad moved space %v", total)
+	}
+}
@@ -0,0 +1,256 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Type of a ring invariant violation
+type ViolationType int
+
+const (
+	ViolationSuccessor      ViolationType = iota // The successor is not the next vnode on the ring
+	ViolationPredecessor                         // The predecessor is not the previous vnode on the ring
+	ViolationSuccessorOrder                      // The successor list is not sorted along the ring
+	ViolationUnknownVnode                        // A successor is not part of the ring
+	ViolationLoop                                // Following successors does not visit every vnode once
+	ViolationFinger                              // A finger does not point to the successor of its offset
+	ViolationUnreachable                         // A vnode referenced by the ring did not answer
+)
+
+func (t ViolationType) String() string {
+	switch t {
+	case ViolationSuccessor:
+		return "Successor"
+	case ViolationPredecessor:
+		return "Predecessor"
+	case ViolationSuccessorOrder:
+		return "SuccessorOrder"
+	case ViolationUnknownVnode:
+		return "UnknownVnode"
+	case ViolationLoop:
+		return "Loop"
+	case ViolationFinger:
+		return "Finger"
+	case ViolationUnreachable:
+		return "Unreachable"
+	default:
+		return "Unknown"
+	}
+}
+
+// A broken ring invariant, with the vnodes involved
+type Violation struct {
+	Type     ViolationType
+	Vnode    *Vnode   // The vnode breaking the invariant
+	Expected *Vnode   // The vnode in the ideal ring, if any
+	Actual   *Vnode   // The vnode found instead, if any
+	Finger   int      // The finger table entry, for ViolationFinger
+	Vnodes   []*Vnode // The successor list or the followed path
+}
+
+func (v Violation) String() string {
+	desc := fmt.Sprintf("%s violation at %s", v.Type, vnodeName(v.Vnode))
+	if v.Type == ViolationFinger {
+		desc += fmt.Sprintf(" finger %d", v.Finger)
+	}
+	if v.Expected != nil || v.Actual != nil {
+		desc += fmt.Sprintf(": expected %s, got %s", vnodeName(v.Expected), vnodeName(v.Actual))
+	}
+	if len(v.Vnodes) > 0 {
+		names := make([]string, len(v.Vnodes))
+		for i, vn := range v.Vnodes {
+			names[i] = vnodeName(vn)
+		}
+		desc += fmt.Sprintf(" %v", names)
+	}
+	return desc
+}
+
+// Names a vnode by host and ID
+func vnodeName(vn *Vnode) string {
+	if vn == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s:%s", vn.Host, vn.String())
+}
+
+// The observed state of a vnode
+type vnodeState struct {
+	vn          *Vnode
+	predecessor *Vnode
+	successors  []*Vnode
+	finger      []*Vnode // Nil when not known
+}
+
+// Checks that the vnodes of the given in-process rings form a single
+// correct ring, including their finger tables. Returns every violation.
+func CheckRings(rings ...*Ring) []Violation {
+	var states []*vnodeState
+	hashBits := 0
+	for _, r := range rings {
+		hashBits = r.config.hashBits
+		for _, vn := range r.vnodes {
+			vn.lock.RLock()
+			states = append(states, &vnodeState{
+				vn:          &vn.Vnode,
+				predecessor: vn.predecessor,
+				successors:  trimSlice(append([]*Vnode(nil), vn.successors...)),
+				finger:      append([]*Vnode(nil), vn.finger...),
+			})
+			vn.lock.RUnlock()
+		}
+	}
+	return checkStates(states, hashBits)
+}
+
+// Crawls a ring over the transport, starting from the vnodes of a host
+// and following predecessors and successors, then checks that the
+// reachable vnodes form a correct ring. Finger tables are not available
+// over the transport and are not checked.
+func CrawlRing(trans Transport, host string, numSuccessors int) ([]Violation, error) {
+	queue, err := trans.ListVnodes(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*vnodeState
+	var violations []Violation
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		vn := queue[0]
+		queue = queue[1:]
+		if vn == nil || seen[vn.idKey()] {
+			continue
+		}
+		seen[vn.idKey()] = true
+
+		// Our successor list is returned for the key right after us
+		pred, err := trans.GetPredecessor(vn)
+		if err != nil {
+			violations = append(violations, Violation{Type: ViolationUnreachable, Vnode: vn})
+			continue
+		}
+		next := powerOffset(vn.Id, 0, len(vn.Id)*8)
+		_, succs, err := trans.FindSuccessors(vn, numSuccessors, next, NewLookupMetaData())
+		if err != nil {
+			violations = append(violations, Violation{Type: ViolationUnreachable, Vnode: vn})
+			continue
+		}
+		succs = trimSlice(succs)
+		states = append(states, &vnodeState{vn: vn, predecessor: pred, successors: succs})
+		queue = append(queue, pred)
+		queue = append(queue, succs...)
+	}
+	return append(violations, checkStates(states, 0)...), nil
+}
+
+// Checks the vnode states against the ideal ring formed by their IDs
+func checkStates(states []*vnodeState, hashBits int) []Violation {
+	if len(states) == 0 {
+		return nil
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return bytes.Compare(states[i].vn.Id, states[j].vn.Id) < 0
+	})
+	byID := make(map[string]int, len(states))
+	for i, s := range states {
+		byID[s.vn.idKey()] = i
+	}
+	num := len(states)
+
+	// The first vnode at or after a key
+	idealSuccessor := func(key []byte) *Vnode {
+		idx := sort.Search(num, func(i int) bool {
+			return bytes.Compare(states[i].vn.Id, key) >= 0
+		})
+		return states[idx%num].vn
+	}
+
+	var violations []Violation
+	for i, s := range states {
+		next := states[(i+1)%num].vn
+		prev := states[(i+num-1)%num].vn
+
+		// Immediate neighbors
+		var succ *Vnode
+		if len(s.successors) > 0 {
+			succ = s.successors[0]
+		}
+		if !sameVnode(succ, next) {
+			violations = append(violations, Violation{Type: ViolationSuccessor,
+				Vnode: s.vn, Expected: next, Actual: succ})
+		}
+		if !sameVnode(s.predecessor, prev) {
+			violations = append(violations, Violation{Type: ViolationPredecessor,
+				Vnode: s.vn, Expected: prev, Actual: s.predecessor})
+		}
+
+		// Successors must be known and strictly further along the ring
+		bits := len(s.vn.Id) * 8
+		var last ID
+		for idx, other := range s.successors {
+			if other == nil {
+				continue
+			}
+			if _, ok := byID[other.idKey()]; !ok {
+				violations = append(violations, Violation{Type: ViolationUnknownVnode,
+					Vnode: s.vn, Actual: other, Vnodes: s.successors})
+			}
+			dist := distance(s.vn.Id, other.Id, bits)
+			if idx > 0 && dist.Cmp(last) <= 0 {
+				violations = append(violations, Violation{Type: ViolationSuccessorOrder,
+					Vnode: s.vn, Vnodes: s.successors})
+				break
+			}
+			last = dist
+		}
+
+		// Fingers point to the successor of their offset
+		for idx, finger := range s.finger {
+			if finger == nil || idx >= hashBits {
+				continue
+			}
+			expected := idealSuccessor(powerOffset(s.vn.Id, idx, hashBits))
+			if !sameVnode(finger, expected) {
+				violations = append(violations, Violation{Type: ViolationFinger,
+					Vnode: s.vn, Finger: idx, Expected: expected, Actual: finger})
+			}
+		}
+	}
+	return append(violations, checkLoop(states, byID)...)
+}
+
+// Follows the successors from the first vnode, which must visit every
+// vnode exactly once before coming back
+func checkLoop(states []*vnodeState, byID map[string]int) []Violation {
+	start := states[0].vn
+	visited := make(map[int]bool)
+	path := []*Vnode{start}
+	idx := 0
+	for {
+		visited[idx] = true
+		s := states[idx]
+		if len(s.successors) == 0 {
+			return []Violation{{Type: ViolationLoop, Vnode: s.vn, Vnodes: path}}
+		}
+		succ := s.successors[0]
+		next, ok := byID[succ.idKey()]
+		if !ok {
+			// Reported as a successor violation
+			return nil
+		}
+		path = append(path, succ)
+		if next == 0 {
+			if len(visited) != len(states) {
+				return []Violation{{Type: ViolationLoop, Vnode: start, Vnodes: path}}
+			}
+			return nil
+		}
+		if visited[next] {
+			return []Violation{{Type: ViolationLoop, Vnode: succ, Vnodes: path}}
+		}
+		idx = next
+	}
+}
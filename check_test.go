@@ -0,0 +1,174 @@
+package chord
+
+import (
+	"testing"
+)
+
+// Sets up a correct ring without running stabilize
+func makeCheckedRing() *Ring {
+	ring := makeRing()
+	ring.setLocalSuccessors()
+	num := len(ring.vnodes)
+	for idx, vn := range ring.vnodes {
+		vn.predecessor = &ring.vnodes[(idx+num-1)%num].Vnode
+	}
+	return ring
+}
+
+// Counts the violations of a type
+func countViolations(violations []Violation, vt ViolationType) int {
+	count := 0
+	for _, v := range violations {
+		if v.Type == vt {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCheckRingsCorrect(t *testing.T) {
+	ring := makeCheckedRing()
+	if v := CheckRings(ring); len(v) != 0 {
+		t.Fatalf("unexpected violations %v", v)
+	}
+}
+
+func TestCheckRingsSuccessor(t *testing.T) {
+	ring := makeCheckedRing()
+	vn := ring.vnodes[0]
+	vn.successors[0], vn.successors[1] = vn.successors[1], vn.successors[0]
+
+	v := CheckRings(ring)
+	if countViolations(v, ViolationSuccessor) != 1 {
+		t.Fatalf("expected a successor violation %v", v)
+	}
+	if countViolations(v, ViolationSuccessorOrder) != 1 {
+		t.Fatalf("expected an order violation %v", v)
+	}
+	// The ring skips vnodes[1]
+	if countViolations(v, ViolationLoop) != 1 {
+		t.Fatalf("expected a loop violation %v", v)
+	}
+	for _, viol := range v {
+		if viol.Type == ViolationSuccessor {
+			if viol.Vnode != &vn.Vnode || viol.Expected != &ring.vnodes[1].Vnode ||
+				viol.Actual != &ring.vnodes[2].Vnode {
+				t.Fatalf("bad violation %s", viol)
+			}
+		}
+	}
+}
+
+func TestCheckRingsPredecessor(t *testing.T) {
+	ring := makeCheckedRing()
+	ring.vnodes[2].predecessor = &ring.vnodes[0].Vnode
+	ring.vnodes[3].predecessor = nil
+
+	v := CheckRings(ring)
+	if len(v) != 2 || countViolations(v, ViolationPredecessor) != 2 {
+		t.Fatalf("expected predecessor violations %v", v)
+	}
+}
+
+func TestCheckRingsUnknown(t *testing.T) {
+	ring := makeCheckedRing()
+	ring.vnodes[4].successors[2] = &Vnode{Id: []byte{42}, Host: "gone"}
+
+	v := CheckRings(ring)
+	if countViolations(v, ViolationUnknownVnode) != 1 {
+		t.Fatalf("expected an unknown vnode violation %v", v)
+	}
+}
+
+func TestCheckRingsLoop(t *testing.T) {
+	ring := makeCheckedRing()
+	// vnodes[2] points back to vnodes[1]
+	ring.vnodes[2].successors[0] = &ring.vnodes[1].Vnode
+
+	v := CheckRings(ring)
+	if countViolations(v, ViolationLoop) != 1 {
+		t.Fatalf("expected a loop violation %v", v)
+	}
+}
+
+func TestCheckRingsFingers(t *testing.T) {
+	ring := makeCheckedRing()
+	vn := ring.vnodes[0]
+	vn.finger[0] = &ring.vnodes[1].Vnode
+	vn.finger[1] = &ring.vnodes[3].Vnode
+
+	v := CheckRings(ring)
+	if len(v) != 1 || v[0].Type != ViolationFinger || v[0].Finger != 1 {
+		t.Fatalf("expected a finger violation %v", v)
+	}
+	if v[0].Expected != &ring.vnodes[1].Vnode {
+		t.Fatalf("bad expected finger %s", v[0])
+	}
+}
+
+func TestCheckRingsStabilized(t *testing.T) {
+	trans := InitLocalTransportFakeTcp(nil, nil)
+	conf1 := fastConf()
+	conf1.Hostname = "node1"
+	r1, err := Create(conf1, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf2 := fastConf()
+	conf2.Hostname = "node2"
+	r2, err := Join(conf2, trans, "node1")
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+
+	waitFor(t, "the ring to stabilize", func() bool {
+		return len(CheckRings(r1, r2)) == 0
+	})
+
+	// The crawl finds every vnode from either host
+	waitFor(t, "the crawl to pass", func() bool {
+		v, err := CrawlRing(trans, "node2", conf1.NumSuccessors)
+		return err == nil && len(v) == 0
+	})
+
+	// A missing node breaks the ring
+	if v := CheckRings(r1); len(v) == 0 {
+		t.Fatalf("expected violations")
+	}
+
+	r1.Shutdown()
+	r2.Shutdown()
+}
+
+func TestCrawlRingUnreachable(t *testing.T) {
+	trans := InitLocalTransportFakeTcp(nil, nil)
+	conf1 := fastConf()
+	conf1.Hostname = "node1"
+	r1, err := Create(conf1, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf2 := fastConf()
+	conf2.Hostname = "node2"
+	r2, err := Join(conf2, trans, "node1")
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+	waitFor(t, "the ring to stabilize", func() bool {
+		return len(CheckRings(r1, r2)) == 0
+	})
+
+	// Node 2 disappears before node 1 notices
+	r1.Shutdown()
+	r2.Shutdown()
+	for _, vn := range r2.vnodes {
+		trans.(*LocalTransport).Deregister(&vn.Vnode)
+	}
+	v, err := CrawlRing(trans, "node1", conf1.NumSuccessors)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if countViolations(v, ViolationUnreachable) == 0 {
+		t.Fatalf("expected unreachable vnodes %v", v)
+	}
+}
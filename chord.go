@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"go-chord/stats"
 	"hash"
+	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -35,10 +37,30 @@ type Transport interface {
 	// Instructs a node to skip a given successor. Used to leave.
 	SkipSuccessor(target, self *Vnode) error
 
+	// Exchanges cluster information with a node. Used to join.
+	Handshake(*Vnode, *ClusterInfo) (*ClusterInfo, error)
+
+	// Hands over the neighbors of a leaving vnode. Used to leave.
+	LeaveHandover(*Vnode, *LeaveInfo) error
+
 	// Register for an RPC callbacks
 	Register(*Vnode, VnodeRPC)
 }
 
+// Implemented by transports that can find the successors of many keys in
+// a single request. Other transports are sent a request per key.
+type BatchTransport interface {
+	// Find the successors of many keys, results are in the order of the keys
+	FindSuccessorsMany(*Vnode, int, [][]byte) ([][]*Vnode, error)
+}
+
+// Neighbors handed over by a leaving vnode
+type LeaveInfo struct {
+	Vnode       *Vnode   // The leaving vnode
+	Predecessor *Vnode   // Its predecessor, for its successor
+	Successors  []*Vnode // Its successors, for its predecessor
+}
+
 // Meta data that is passed along and updated at each node
 type LookupMetaData struct {
 	LookupPath    []*Vnode
@@ -59,6 +81,14 @@ type VnodeRPC interface {
 	FindSuccessors(int, []byte, LookupMetaData) (LookupMetaData, []*Vnode, error)
 	ClearPredecessor(*Vnode) error
 	SkipSuccessor(*Vnode) error
+	Handshake(*ClusterInfo) (*ClusterInfo, error)
+	LeaveHandover(*LeaveInfo) error
+}
+
+// Implemented by registered vnodes that can find the successors of many
+// keys at once
+type BatchVnodeRPC interface {
+	FindSuccessorsMany(int, [][]byte) ([][]*Vnode, error)
 }
 
 // Delegate to notify on ring events
@@ -72,35 +102,53 @@ type Delegate interface {
 
 // Configuration for Chord nodes
 type Config struct {
-	Hostname      string           // Local host name
-	NumVnodes     int              // Number of vnodes per physical node
-	HashFunc      func() hash.Hash // Hash function to use
-	StabilizeMin  time.Duration    // Minimum stabilization time
-	StabilizeMax  time.Duration    // Maximum stabilization time
-	NumSuccessors int              // Number of successors to maintain
-	Delegate      Delegate         // Invoked to handle ring events
-	Stats         stats.ChordStats // Collect chord statistics
-	UseCache      bool             // Use a cache of nodes and their hash values
-	hashBits      int              // Bit size of the hash function
+	Hostname      string            // Advertised address, dialed by other nodes
+	NodeName      string            // Stable name hashed into the vnode IDs, defaults to Hostname
+	BindAddr      string            // Address the transport listens on, defaults to Hostname
+	NumVnodes     int               // Number of vnodes per physical node
+	HashFunc      func() hash.Hash  // Hash function to use
+	StabilizeMin  time.Duration     // Minimum stabilization time
+	StabilizeMax  time.Duration     // Maximum stabilization time
+	NumSuccessors int               // Number of successors to maintain
+	Delegate      Delegate          // Invoked to handle ring events
+	Stats         stats.ChordStats  // Collect chord statistics
+	UseCache      bool              // Use a cache of nodes and their hash values
+	CacheSize     int               // Maximum number of nodes in the cache, 0 for unbounded
+	CacheTTL      time.Duration     // Maximum age of a cached node, 0 to never expire
+	Meta          map[string]string // Metadata advertised with the local vnodes
+	ClusterName   string            // Name of the cluster, checked when joining
+	LeaveTimeout  time.Duration     // Maximum wait for the neighbors to acknowledge a leave, 0 for no limit
+	Seeds         []string          // Hosts to recover from when all successors are lost
+	MergeInterval time.Duration     // How often to look for other rings to merge with, 0 to disable
+	Clock         Clock             // Source of time and stabilization timers, nil for the wall clock
+	Rand          *rand.Rand        // Source of randomness, nil for the global source. Rings sharing it need a NewLockedSource
+	hashBits      int               // Bit size of the hash function
 }
 
 // Represents an Vnode, local or remote
 type Vnode struct {
-	Id   []byte // Virtual ID
-	Host string // Host identifier
+	Id   []byte            // Virtual ID
+	Host string            // Host identifier
+	Meta map[string]string // Host metadata, must not be modified
 }
 
-// Represents a local Vnode
+// Represents a local Vnode. The lock guards the successors, fingers,
+// predecessor, isolation, timer and shutdown channel, which RPCs use
+// while the vnode stabilizes. It is never held across an RPC.
 type localVnode struct {
 	Vnode
 	ring        *Ring
+	lock        sync.RWMutex
 	successors  []*Vnode
 	finger      []*Vnode
-	nodeCache   map[string]*Vnode
+	nodeCache   *nodeCache
 	last_finger int
 	predecessor *Vnode
 	stabilized  time.Time
-	timer       *time.Timer
+	timer       Timer
+	shutdown    chan bool
+	isolated    bool
+	merged      time.Time
 }
 
 // Stores the state required for a Chord ring
@@ -108,15 +156,18 @@ type Ring struct {
 	config     *Config
 	transport  Transport
 	vnodes     []*localVnode
-	nodeCache  map[string]*Vnode
 	delegateCh chan func()
-	shutdown   chan bool
+	meta       map[string]string
+	subscribers
+	peers
 }
 
 // Returns the default Ring configuration
 func DefaultConfig(hostname string) *Config {
 	return &Config{
 		hostname,
+		"",       // name the node by its hostname
+		"",       // listen on the hostname
 		8,        // 8 vnodes
 		sha1.New, // SHA1
 		time.Duration(15 * time.Second),
@@ -124,15 +175,26 @@ func DefaultConfig(hostname string) *Config {
 		8,   // 8 successors
 		nil, // No delegate
 		&stats.BlackholeStats{},
-		true, // use a cache
-		160,  // 160bit hash function
+		true,            // use a cache
+		1024,            // cache up to 1024 nodes
+		5 * time.Minute, // expire cached nodes after 5 minutes
+		nil,             // no metadata
+		"",              // no cluster name
+		5 * time.Second, // wait up to 5 seconds when leaving
+		nil,             // no seeds
+		time.Minute,     // look for other rings every minute
+		nil,             // use the wall clock
+		nil,             // use the global random source
+		160,             // 160bit hash function
 	}
 }
 
 // Creates a new Chord ring given the config and transport
 func Create(conf *Config, trans Transport) (*Ring, error) {
 	// Initialize the hash bits
-	conf.hashBits = conf.HashFunc().Size() * 8
+	if err := initHashBits(conf); err != nil {
+		return nil, err
+	}
 
 	// Create and initialize a ring
 	ring := &Ring{}
@@ -145,7 +207,9 @@ func Create(conf *Config, trans Transport) (*Ring, error) {
 // Joins an existing Chord ring
 func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 	// Initialize the hash bits
-	conf.hashBits = conf.HashFunc().Size() * 8
+	if err := initHashBits(conf); err != nil {
+		return nil, err
+	}
 
 	// Request a list of Vnodes from the remote host
 	hosts, err := trans.ListVnodes(existing)
@@ -156,9 +220,15 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 		return nil, fmt.Errorf("Remote host has no vnodes!")
 	}
 
+	// Check that the remote host is compatible
+	if err := handshake(conf, trans, hosts[0]); err != nil {
+		return nil, err
+	}
+
 	// Create a ring
 	ring := &Ring{}
 	ring.init(conf, trans)
+	ring.rememberPeer(existing)
 
 	// Acquire a live successor for each Vnode
 	for _, vn := range ring.vnodes {
@@ -187,6 +257,31 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 	return ring, nil
 }
 
+// Returns the address the transport should listen on
+func (c *Config) ListenAddr() string {
+	if c.BindAddr != "" {
+		return c.BindAddr
+	}
+	return c.Hostname
+}
+
+// Returns the stable name used to generate the vnode IDs
+func (c *Config) nodeName() string {
+	if c.NodeName != "" {
+		return c.NodeName
+	}
+	return c.Hostname
+}
+
+// Sets the bit size of the hash function, which must fit in an ID
+func initHashBits(conf *Config) error {
+	conf.hashBits = conf.HashFunc().Size() * 8
+	if conf.hashBits > MaxIDBits {
+		return fmt.Errorf("Hash function is too wide! Got %d bits, max is %d", conf.hashBits, MaxIDBits)
+	}
+	return nil
+}
+
 // Leaves a given Chord ring and shuts down the local vnodes
 func (r *Ring) Leave() error {
 	// Shutdown the vnodes first to avoid further stabilization runs
@@ -200,6 +295,7 @@ func (r *Ring) Leave() error {
 
 	// Wait for the delegate callbacks to complete
 	r.stopDelegate()
+	r.closeSubscriptions()
 	return err
 }
 
@@ -208,6 +304,7 @@ func (r *Ring) Leave() error {
 func (r *Ring) Shutdown() {
 	r.stopVnodes()
 	r.stopDelegate()
+	r.closeSubscriptions()
 }
 
 // Does a key lookup for up to N successors of a key
@@ -221,29 +318,130 @@ func (r *Ring) Lookup(n int, key []byte) ([]*Vnode, error) {
 	h := r.config.HashFunc()
 	h.Write(key)
 	key_hash := h.Sum(nil)
+	return r.lookup(n, key_hash)
+}
+
+// Does a lookup for up to N successors of an ID that is already hashed.
+// The result includes the predecessor of the owning vnode, so callers
+// learn the (Predecessor, Owner] range of IDs the owner is responsible for.
+func (r *Ring) LookupID(n int, id []byte) (*LookupResult, error) {
+	// Ensure that n and the ID are sane
+	if n > r.config.NumSuccessors {
+		return nil, fmt.Errorf("Cannot ask for more successors than NumSuccessors!")
+	}
+	if len(id)*8 != r.config.hashBits {
+		return nil, fmt.Errorf("ID must be %d bits! Got %d", r.config.hashBits, len(id)*8)
+	}
 
+	successors, err := r.lookup(n, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask the owner for its predecessor
+	pred, err := r.transport.GetPredecessor(successors[0])
+	if err != nil {
+		return nil, err
+	}
+	return &LookupResult{Successors: successors, Predecessor: pred}, nil
+}
+
+// Result of an ID lookup
+type LookupResult struct {
+	Successors  []*Vnode // Successors of the ID, the first is the owner
+	Predecessor *Vnode   // Predecessor of the owner, nil if not yet known
+}
+
+// Returns the vnode that owns the ID
+func (lr *LookupResult) Owner() *Vnode {
+	return lr.Successors[0]
+}
+
+// Checks if an ID is in the (Predecessor, Owner] range, and so is owned
+// by the same vnode. Always false if the predecessor is not known.
+func (lr *LookupResult) Contains(id []byte) bool {
+	if lr.Predecessor == nil {
+		return false
+	}
+	return betweenRightIncl(lr.Predecessor.Id, lr.Owner().Id, id)
+}
+
+// Looks up the successors of a hashed key from the nearest local vnode
+func (r *Ring) lookup(n int, key_hash []byte) ([]*Vnode, error) {
 	// Find the nearest local vnode
 	nearest := r.nearestVnode(key_hash)
 
 	// Use the nearest node for the lookup
-	startTime := time.Now()
+	startTime := r.config.clock().Now()
 	meta, successors, err := nearest.FindSuccessors(n, key_hash, NewLookupMetaData())
 	if err != nil {
 		return nil, err
 	}
-	elapsedTime := time.Since(startTime)
-	go func() {
-		r.config.Stats.LookupTime(elapsedTime)
-		r.config.Stats.LookupNumberOfJumps(len(meta.LookupPath))
-		r.config.Stats.LookupCountIncr()
+
+	// Record the stats before returning, so they are complete once the
+	// lookups are done
+	if stats := r.config.Stats; stats != nil {
+		stats.LookupTime(r.config.since(startTime))
+		stats.LookupNumberOfJumps(len(meta.LookupPath))
+		stats.LookupCountIncr()
 		if meta.IsCacheLookup {
-			r.config.Stats.SuccessfulCacheResult()
+			stats.SuccessfulCacheResult()
 		}
-	}()
+	}
 
 	// Trim the nil successors
-	for successors[len(successors)-1] == nil {
-		successors = successors[:len(successors)-1]
+	successors = trimSlice(successors)
+	if len(successors) == 0 {
+		return nil, fmt.Errorf("Lookup returned no successors!")
 	}
 	return successors, nil
 }
+
+// Does a lookup for up to N successors of each of the keys. Keys are
+// batched so that each hop receives a single request for all the keys
+// routed through it. Returns the successors of each key in the order of
+// the keys. If some keys could not be resolved, their results are empty
+// and the results for the other keys are returned along with an error.
+// Results are a slice rather than a map by key, so that keys given
+// more than once each get their own result.
+func (r *Ring) LookupMany(n int, keys [][]byte) ([][]*Vnode, error) {
+	// Ensure that n is sane
+	if n > r.config.NumSuccessors {
+		return nil, fmt.Errorf("Cannot ask for more successors than NumSuccessors!")
+	}
+
+	// Hash the keys and group them by the nearest local vnode
+	hashes := make([][]byte, len(keys))
+	byVnode := make(map[*localVnode][]int)
+	for i, key := range keys {
+		h := r.config.HashFunc()
+		h.Write(key)
+		hashes[i] = h.Sum(nil)
+		nearest := r.nearestVnode(hashes[i])
+		byVnode[nearest] = append(byVnode[nearest], i)
+	}
+
+	// Use each local vnode for its keys
+	results := make([][]*Vnode, len(keys))
+	var err error
+	for vn, idxs := range byVnode {
+		batch := make([][]byte, len(idxs))
+		for j, idx := range idxs {
+			batch[j] = hashes[idx]
+		}
+		res, e := vn.FindSuccessorsMany(n, batch)
+		if e != nil {
+			err = mergeErrors(err, e)
+			continue
+		}
+		for j, idx := range idxs {
+			successors := trimSlice(res[j])
+			if len(successors) == 0 {
+				err = mergeErrors(err, fmt.Errorf("Failed to find successors for key %q", keys[idx]))
+				continue
+			}
+			results[idx] = successors
+		}
+	}
+	return results, err
+}
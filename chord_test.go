@@ -1,13 +1,18 @@
 package chord
 
 import (
+	"crypto/sha512"
+	"go-chord/stats"
+	"hash"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
 
 type MultiLocalTrans struct {
 	remote Transport
+	lock   sync.RWMutex
 	hosts  map[string]*LocalTransport
 }
 
@@ -20,7 +25,7 @@ func InitMLTransport() *MultiLocalTrans {
 }
 
 func (ml *MultiLocalTrans) ListVnodes(host string) ([]*Vnode, error) {
-	if local, ok := ml.hosts[host]; ok {
+	if local, ok := ml.local(host); ok {
 		return local.ListVnodes(host)
 	}
 	return ml.remote.ListVnodes(host)
@@ -28,7 +33,7 @@ func (ml *MultiLocalTrans) ListVnodes(host string) ([]*Vnode, error) {
 
 // Ping a Vnode, check for liveness
 func (ml *MultiLocalTrans) Ping(v *Vnode) (bool, error) {
-	if local, ok := ml.hosts[v.Host]; ok {
+	if local, ok := ml.local(v.Host); ok {
 		return local.Ping(v)
 	}
 	return ml.remote.Ping(v)
@@ -36,7 +41,7 @@ func (ml *MultiLocalTrans) Ping(v *Vnode) (bool, error) {
 
 // Request a nodes predecessor
 func (ml *MultiLocalTrans) GetPredecessor(v *Vnode) (*Vnode, error) {
-	if local, ok := ml.hosts[v.Host]; ok {
+	if local, ok := ml.local(v.Host); ok {
 		return local.GetPredecessor(v)
 	}
 	return ml.remote.GetPredecessor(v)
@@ -44,7 +49,7 @@ func (ml *MultiLocalTrans) GetPredecessor(v *Vnode) (*Vnode, error) {
 
 // Notify our successor of ourselves
 func (ml *MultiLocalTrans) Notify(target, self *Vnode) ([]*Vnode, error) {
-	if local, ok := ml.hosts[target.Host]; ok {
+	if local, ok := ml.local(target.Host); ok {
 		return local.Notify(target, self)
 	}
 	return ml.remote.Notify(target, self)
@@ -52,15 +57,23 @@ func (ml *MultiLocalTrans) Notify(target, self *Vnode) ([]*Vnode, error) {
 
 // Find a successor
 func (ml *MultiLocalTrans) FindSuccessors(v *Vnode, n int, k []byte, meta LookupMetaData) (LookupMetaData, []*Vnode, error) {
-	if local, ok := ml.hosts[v.Host]; ok {
+	if local, ok := ml.local(v.Host); ok {
 		return local.FindSuccessors(v, n, k, meta)
 	}
 	return ml.remote.FindSuccessors(v, n, k, meta)
 }
 
+// Find the successors of many keys
+func (ml *MultiLocalTrans) FindSuccessorsMany(v *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	if local, ok := ml.local(v.Host); ok {
+		return local.FindSuccessorsMany(v, n, keys)
+	}
+	return findSuccessorsMany(ml.remote, v, n, keys)
+}
+
 // Clears a predecessor if it matches a given vnode. Used to leave.
 func (ml *MultiLocalTrans) ClearPredecessor(target, self *Vnode) error {
-	if local, ok := ml.hosts[target.Host]; ok {
+	if local, ok := ml.local(target.Host); ok {
 		return local.ClearPredecessor(target, self)
 	}
 	return ml.remote.ClearPredecessor(target, self)
@@ -68,13 +81,31 @@ func (ml *MultiLocalTrans) ClearPredecessor(target, self *Vnode) error {
 
 // Instructs a node to skip a given successor. Used to leave.
 func (ml *MultiLocalTrans) SkipSuccessor(target, self *Vnode) error {
-	if local, ok := ml.hosts[target.Host]; ok {
+	if local, ok := ml.local(target.Host); ok {
 		return local.SkipSuccessor(target, self)
 	}
 	return ml.remote.SkipSuccessor(target, self)
 }
 
+// Exchanges cluster information with a node. Used to join.
+func (ml *MultiLocalTrans) Handshake(v *Vnode, info *ClusterInfo) (*ClusterInfo, error) {
+	if local, ok := ml.local(v.Host); ok {
+		return local.Handshake(v, info)
+	}
+	return ml.remote.Handshake(v, info)
+}
+
+// Hands over the neighbors of a leaving vnode. Used to leave.
+func (ml *MultiLocalTrans) LeaveHandover(v *Vnode, info *LeaveInfo) error {
+	if local, ok := ml.local(v.Host); ok {
+		return local.LeaveHandover(v, info)
+	}
+	return ml.remote.LeaveHandover(v, info)
+}
+
 func (ml *MultiLocalTrans) Register(v *Vnode, o VnodeRPC) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
 	local, ok := ml.hosts[v.Host]
 	if !ok {
 		local = InitLocalTransport(nil).(*LocalTransport)
@@ -84,9 +115,19 @@ func (ml *MultiLocalTrans) Register(v *Vnode, o VnodeRPC) {
 }
 
 func (ml *MultiLocalTrans) Deregister(host string) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
 	delete(ml.hosts, host)
 }
 
+// Returns the local transport of a host
+func (ml *MultiLocalTrans) local(host string) (*LocalTransport, bool) {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	local, ok := ml.hosts[host]
+	return local, ok
+}
+
 var _ = Transport(&MultiLocalTrans{})
 
 func TestDefaultConfig(t *testing.T) {
@@ -115,6 +156,17 @@ func TestDefaultConfig(t *testing.T) {
 	if conf.Delegate != nil {
 		t.Fatalf("bad delegate")
 	}
+	if conf.CacheSize != 1024 {
+		t.Fatalf("bad cache size")
+	}
+	if conf.ListenAddr() != "test" || conf.nodeName() != "test" {
+		t.Fatalf("bad default addresses")
+	}
+	conf.BindAddr = ":8000"
+	conf.NodeName = "node1"
+	if conf.ListenAddr() != ":8000" || conf.nodeName() != "node1" {
+		t.Fatalf("bad addresses")
+	}
 }
 
 func fastConf() *Config {
@@ -140,6 +192,52 @@ func TestCreateShutdown(t *testing.T) {
 	}
 }
 
+// A hash function reporting a size wider than an ID
+type wideHash struct{ hash.Hash }
+
+func (wideHash) Size() int { return MaxIDBits/8 + 1 }
+
+func TestCreateHashWidth(t *testing.T) {
+	// SHA-512 fills a whole ID
+	ml := InitMLTransport()
+	conf := fastConf()
+	conf.HashFunc = sha512.New
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.HashFunc = sha512.New
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	for _, k := range []string{"test", "foo", "bar"} {
+		vn1, err := r.Lookup(1, []byte(k))
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		vn2, err := r2.Lookup(1, []byte(k))
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if vn1[0].String() != vn2[0].String() {
+			t.Fatalf("lookups differ for %s", k)
+		}
+	}
+	r.Shutdown()
+	r2.Shutdown()
+
+	// Wider hashes are rejected
+	conf = fastConf()
+	conf.HashFunc = func() hash.Hash { return wideHash{sha512.New()} }
+	if _, err := Create(conf, nil); err == nil {
+		t.Fatalf("expected err!")
+	}
+}
+
 func TestJoin(t *testing.T) {
 	// Create a multi transport
 	ml := InitMLTransport()
@@ -275,3 +373,146 @@ func TestLookup(t *testing.T) {
 		}
 	}
 }
+
+// Counts the lookups
+type lookupStats struct {
+	stats.BlackholeStats
+	lookups int
+}
+
+func (s *lookupStats) LookupCountIncr() {
+	s.lookups++
+}
+
+func TestLookupStats(t *testing.T) {
+	conf := fastConf()
+	st := &lookupStats{}
+	conf.Stats = st
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	<-time.After(50 * time.Millisecond)
+
+	// Each lookup is counted by the time it returns
+	for i, k := range []string{"test", "foo", "bar"} {
+		if _, err := r.Lookup(1, []byte(k)); err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if st.lookups != i+1 {
+			t.Fatalf("expected %d lookups, got %d", i+1, st.lookups)
+		}
+	}
+	r.Shutdown()
+}
+
+func TestLookupMany(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Wait for some stabilization
+	<-time.After(100 * time.Millisecond)
+
+	// Batch lookups should match single lookups
+	keys := [][]byte{[]byte("test"), []byte("foo"), []byte("bar"), []byte("baz"), []byte("foo")}
+	res, err := r2.LookupMany(3, keys)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(res) != len(keys) {
+		t.Fatalf("bad result count %d", len(res))
+	}
+	for i, k := range keys {
+		vns, err := r.Lookup(3, k)
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		batch := res[i]
+		if len(batch) != len(vns) {
+			t.Fatalf("result len differs!")
+		}
+		for idx := range vns {
+			if vns[idx].String() != batch[idx].String() {
+				t.Fatalf("results differ!")
+			}
+		}
+	}
+
+	if _, err := r.LookupMany(10, keys); err == nil {
+		t.Fatalf("expected err!")
+	}
+	r.Shutdown()
+	r2.Shutdown()
+}
+
+func TestLookupID(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Wait for some stabilization
+	<-time.After(100 * time.Millisecond)
+
+	// Looking up the hash should match the key lookup
+	h := conf.HashFunc()
+	h.Write([]byte("test"))
+	id := h.Sum(nil)
+	vns, err := r.Lookup(3, []byte("test"))
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	res, err := r2.LookupID(3, id)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if res.Owner().String() != vns[0].String() {
+		t.Fatalf("owner differs!")
+	}
+
+	// The owner covers the ID, and starts right after the predecessor
+	if res.Predecessor == nil {
+		t.Fatalf("expected predecessor")
+	}
+	if !res.Contains(id) || !res.Contains(res.Owner().Id) {
+		t.Fatalf("expected id in range")
+	}
+	if res.Contains(res.Predecessor.Id) {
+		t.Fatalf("predecessor should not be in range")
+	}
+
+	// IDs must be the width of the hash
+	if _, err := r.LookupID(3, []byte("short")); err == nil {
+		t.Fatalf("expected err!")
+	}
+	r.Shutdown()
+	r2.Shutdown()
+}
@@ -0,0 +1,223 @@
+package chord
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Provides the current time and timers. Replaced by a VirtualClock to
+// simulate rings faster than wall time.
+type Clock interface {
+	// Returns the current time
+	Now() time.Time
+
+	// Calls f in its own goroutine or from the clock once d has elapsed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A pending call created by a Clock
+type Timer interface {
+	// Prevents the call, returns false if it already ran or was stopped
+	Stop() bool
+}
+
+// Clock using the wall time
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Returns the configured clock, or the wall clock
+func (c *Config) clock() Clock {
+	if c.Clock == nil {
+		return wallClock{}
+	}
+	return c.Clock
+}
+
+// Returns the time elapsed since t on the configured clock
+func (c *Config) since(t time.Time) time.Duration {
+	return c.clock().Now().Sub(t)
+}
+
+// Returns a random number in [0.0,1.0) from the configured source
+func (c *Config) randFloat64() float64 {
+	if c.Rand == nil {
+		return rand.Float64()
+	}
+	return c.Rand.Float64()
+}
+
+// Returns a random number in [0,n) from the configured source
+func (c *Config) randIntn(n int) int {
+	if c.Rand == nil {
+		return rand.Intn(n)
+	}
+	return c.Rand.Intn(n)
+}
+
+// Random source that is safe for concurrent use
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source64
+}
+
+// Creates a random source seeded with seed that is safe for concurrent
+// use, so that the rings of a simulation may draw from a single source
+func NewLockedSource(seed int64) rand.Source64 {
+	return &lockedSource{src: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
+
+// VirtualClock is a Clock that only moves when advanced. Due timers run
+// one at a time in the goroutine advancing the clock, in the order of
+// their deadline and then of their creation. Together with a seeded
+// random source this makes a simulation exactly reproducible.
+type VirtualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers virtualTimers
+}
+
+// Creates a virtual clock starting at the given time
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// A pending call on a virtual clock
+type virtualTimer struct {
+	clock *VirtualClock
+	at    time.Time
+	seq   uint64
+	f     func()
+	index int // Position in the heap, -1 once removed
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	t := &virtualTimer{clock: c, at: c.now.Add(d), seq: c.seq, f: f}
+	heap.Push(&c.timers, t)
+	return t
+}
+
+func (t *virtualTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+// Returns the number of pending timers
+func (c *VirtualClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// Moves the clock to the next timer and runs it. Returns false if no
+// timer is pending.
+func (c *VirtualClock) Step() bool {
+	c.lock.Lock()
+	if len(c.timers) == 0 {
+		c.lock.Unlock()
+		return false
+	}
+	t := heap.Pop(&c.timers).(*virtualTimer)
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+	c.lock.Unlock()
+	t.f()
+	return true
+}
+
+// Moves the clock forward by d, running every timer due in the meantime,
+// including the ones they schedule
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	c.lock.Unlock()
+	for {
+		c.lock.Lock()
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			// Nested advances may have gone further already
+			if end.After(c.now) {
+				c.now = end
+			}
+			c.lock.Unlock()
+			return
+		}
+		c.lock.Unlock()
+		c.Step()
+	}
+}
+
+// Heap of virtual timers, earliest first
+type virtualTimers []*virtualTimer
+
+func (h virtualTimers) Len() int { return len(h) }
+
+func (h virtualTimers) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h virtualTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *virtualTimers) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *virtualTimers) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
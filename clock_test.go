@@ -0,0 +1,144 @@
+package chord
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewVirtualClock(start)
+	var order []string
+	record := func(name string) func() {
+		return func() { order = append(order, name) }
+	}
+
+	c.AfterFunc(2*time.Second, record("b"))
+	c.AfterFunc(time.Second, record("a"))
+	c.AfterFunc(2*time.Second, record("c"))
+	stopped := c.AfterFunc(time.Second, record("stopped"))
+	if !stopped.Stop() {
+		t.Fatalf("expected to stop")
+	}
+	if stopped.Stop() {
+		t.Fatalf("already stopped")
+	}
+
+	// Timers scheduled by timers run if they are due
+	c.AfterFunc(1500*time.Millisecond, func() {
+		order = append(order, "nested")
+		c.AfterFunc(100*time.Millisecond, record("inner"))
+	})
+
+	c.Advance(1700 * time.Millisecond)
+	if s := strings.Join(order, ","); s != "a,nested,inner" {
+		t.Fatalf("bad order %s", s)
+	}
+	if !c.Now().Equal(start.Add(1700 * time.Millisecond)) {
+		t.Fatalf("bad time %v", c.Now())
+	}
+	if c.Pending() != 2 {
+		t.Fatalf("bad pending %d", c.Pending())
+	}
+
+	// Ties run in creation order
+	if !c.Step() || !c.Step() || c.Step() {
+		t.Fatalf("bad steps")
+	}
+	if s := strings.Join(order, ","); s != "a,nested,inner,b,c" {
+		t.Fatalf("bad order %s", s)
+	}
+	if !c.Now().Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("bad time %v", c.Now())
+	}
+
+	// Time never goes back when a timer advances past the outer advance
+	c.AfterFunc(time.Second, func() { c.Advance(time.Hour) })
+	c.Advance(2 * time.Second)
+	if !c.Now().Equal(start.Add(time.Hour + 3*time.Second)) {
+		t.Fatalf("bad time %v", c.Now())
+	}
+}
+
+// Builds a ring of nodes on a virtual clock and returns a fingerprint of
+// the resulting vnode state
+func simulateRing(t *testing.T, seed int64, numNodes int) string {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	rnd := rand.New(NewLockedSource(seed))
+	trans := InitLocalTransportFakeTcp(nil, nil)
+
+	var rings []*Ring
+	for i := 0; i < numNodes; i++ {
+		conf := DefaultConfig(fmt.Sprintf("node%d", i))
+		conf.NumVnodes = 4
+		conf.UseCache = false
+		conf.Clock = clock
+		conf.Rand = rnd
+		var r *Ring
+		var err error
+		if i == 0 {
+			r, err = Create(conf, trans)
+		} else {
+			r, err = Join(conf, trans, "node0")
+		}
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		rings = append(rings, r)
+		clock.Advance(conf.StabilizeMax)
+	}
+
+	// Hours of stabilization take no wall time
+	clock.Advance(2 * time.Hour)
+	if v := CheckRings(rings...); len(v) != 0 {
+		t.Fatalf("unexpected violations %v", v)
+	}
+
+	var state []string
+	for _, r := range rings {
+		for _, vn := range r.vnodes {
+			state = append(state, fmt.Sprintf("%s %v %v %v %v", vn.String(),
+				vn.predecessor, vn.successors, vn.finger, vn.stabilized))
+		}
+		r.Shutdown()
+	}
+	if clock.Pending() != 0 {
+		t.Fatalf("timers left after shutdown")
+	}
+	return strings.Join(state, "\n")
+}
+
+func TestVirtualRingDeterministic(t *testing.T) {
+	first := simulateRing(t, 42, 16)
+	if second := simulateRing(t, 42, 16); second != first {
+		t.Fatalf("same seed gave different rings")
+	}
+	if other := simulateRing(t, 7, 16); other == first {
+		t.Fatalf("different seeds gave the same stabilization times")
+	}
+}
+
+func TestConfigRandShared(t *testing.T) {
+	// Rings may share a locked source and draw from it concurrently
+	rnd := rand.New(NewLockedSource(1))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		conf := DefaultConfig("test")
+		conf.Rand = rnd
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if n := conf.randIntn(10); n < 0 || n >= 10 {
+					t.Errorf("bad draw %d", n)
+				}
+				conf.randFloat64()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+package chord
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// Type of a ring event
+type EventType int
+
+const (
+	EventPredecessorChanged   EventType = iota // A local vnode has a new predecessor, or lost it
+	EventSuccessorChanged                      // A local vnode has a new immediate successor
+	EventSuccessorListChanged                  // The successor list of a local vnode changed
+	EventFingerUpdated                         // Entries of a local vnode's finger table changed
+	EventVnodeLeaving                          // A local vnode is leaving the ring
+	EventVnodeIsolated                         // A local vnode lost all its successors and found no remote peer
+	EventVnodeRecovered                        // An isolated local vnode found its successors again
+	EventRingMerged                            // A local vnode adopted a successor from another ring
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPredecessorChanged:
+		return "PredecessorChanged"
+	case EventSuccessorChanged:
+		return "SuccessorChanged"
+	case EventSuccessorListChanged:
+		return "SuccessorListChanged"
+	case EventFingerUpdated:
+		return "FingerUpdated"
+	case EventVnodeLeaving:
+		return "VnodeLeaving"
+	case EventVnodeIsolated:
+		return "VnodeIsolated"
+	case EventVnodeRecovered:
+		return "VnodeRecovered"
+	case EventRingMerged:
+		return "RingMerged"
+	default:
+		return "Unknown"
+	}
+}
+
+// An event on the ring, as seen by one of the local vnodes
+type Event struct {
+	Type       EventType
+	Vnode      *Vnode   // The local vnode
+	Old        *Vnode   // Previous predecessor or successor. The predecessor when leaving
+	New        *Vnode   // New predecessor, successor or finger. The successor when leaving, recovered or merged
+	Successors []*Vnode // Copy of the new successor list, for EventSuccessorListChanged
+	FingerFrom int      // First updated finger table entry, for EventFingerUpdated
+	FingerTo   int      // Last updated finger table entry, for EventFingerUpdated
+}
+
+// A subscription to ring events. Events are delivered on C without ever
+// blocking the ring, any event that does not fit in the buffer is
+// dropped and counted.
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	ring    *Ring
+	dropped uint64
+}
+
+// Holds the subscribers of a ring
+type subscribers struct {
+	subLock    sync.Mutex
+	eventSubs  []*Subscription
+	rangeSubs  []chan RangeChange
+	subsClosed bool
+}
+
+// Returns the number of events dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Stops the subscription and closes the channel
+func (s *Subscription) Close() {
+	r := s.ring
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	for idx, sub := range r.eventSubs {
+		if sub == s {
+			close(s.ch)
+			r.eventSubs = append(r.eventSubs[:idx], r.eventSubs[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Subscribes to the events of the local vnodes, buffering up to the given
+// number of events. Any number of subscribers may be active, and each is
+// closed when the ring shuts down.
+func (r *Ring) Subscribe(buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, ring: r}
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	if r.subsClosed {
+		close(ch)
+	} else {
+		r.eventSubs = append(r.eventSubs, sub)
+	}
+	return sub
+}
+
+// Delivers an event to the subscribers without blocking. Predecessor
+// changes are also delivered to the range subscribers.
+func (r *Ring) publish(ev Event) {
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	for _, sub := range r.eventSubs {
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+
+	if ev.Type != EventPredecessorChanged {
+		return
+	}
+	change := RangeChange{
+		Range: OwnedRange{Owner: ev.Vnode, Predecessor: ev.New},
+		Old:   ev.Old,
+	}
+	for _, sub := range r.rangeSubs {
+		select {
+		case sub <- change:
+		default:
+		}
+	}
+}
+
+// Closes all the subscriptions
+func (r *Ring) closeSubscriptions() {
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	for _, sub := range r.eventSubs {
+		close(sub.ch)
+	}
+	for _, sub := range r.rangeSubs {
+		close(sub)
+	}
+	r.eventSubs = nil
+	r.rangeSubs = nil
+	r.subsClosed = true
+}
+
+// Returns a copy of the successor list, used to detect changes
+func (vn *localVnode) snapshotSuccessors() []*Vnode {
+	vn.lock.RLock()
+	defer vn.lock.RUnlock()
+	return append([]*Vnode(nil), vn.successors...)
+}
+
+// Publishes successor events if the successor list differs from the snapshot
+func (vn *localVnode) publishSuccessors(old []*Vnode) {
+	succs := vn.snapshotSuccessors()
+	changed := false
+	for idx, s := range succs {
+		if !sameVnode(s, old[idx]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	r := vn.ring
+	if !sameVnode(old[0], succs[0]) {
+		r.publish(Event{Type: EventSuccessorChanged, Vnode: &vn.Vnode,
+			Old: old[0], New: succs[0]})
+	}
+	r.publish(Event{Type: EventSuccessorListChanged, Vnode: &vn.Vnode,
+		Successors: succs})
+}
+
+// Checks if two vnodes are the same, either may be nil
+func sameVnode(a, b *Vnode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Id, b.Id)
+}
@@ -0,0 +1,154 @@
+package chord
+
+import (
+	"sort"
+	"testing"
+)
+
+// Reads the next event, failing if there is none
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	select {
+	case ev := <-sub.C:
+		return ev
+	default:
+		t.Fatalf("expected event")
+	}
+	return Event{}
+}
+
+func TestSubscribePredecessor(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	sub := r.Subscribe(4)
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn2.Notify(&vn1.Vnode)
+
+	ev := nextEvent(t, sub)
+	if ev.Type != EventPredecessorChanged || ev.Vnode != &vn2.Vnode || ev.New != &vn1.Vnode || ev.Old != nil {
+		t.Fatalf("bad event %v", ev)
+	}
+}
+
+func TestSubscribeSuccessors(t *testing.T) {
+	v := makeVnode()
+	v.init(0)
+	v.ring.transport = InitLocalTransport(nil)
+	sub := v.ring.Subscribe(4)
+
+	s1 := &Vnode{Id: []byte{10}}
+	s2 := &Vnode{Id: []byte{11}}
+	v.successors[0] = s1
+	v.successors[1] = s2
+
+	// Skipping the successor changes it, and the list
+	v.SkipSuccessor(s1)
+	ev := nextEvent(t, sub)
+	if ev.Type != EventSuccessorChanged || ev.Old != s1 || ev.New != s2 {
+		t.Fatalf("bad event %v", ev)
+	}
+	ev = nextEvent(t, sub)
+	if ev.Type != EventSuccessorListChanged || ev.Successors[0] != s2 || ev.Successors[1] != nil {
+		t.Fatalf("bad event %v", ev)
+	}
+
+	// Skipping another node changes nothing
+	v.SkipSuccessor(s1)
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("unexpected event %v", ev)
+	default:
+	}
+}
+
+func TestSubscribeFinger(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+	}
+	sub := r.Subscribe(4)
+
+	vn := r.vnodes[0]
+	if err := vn.fixFingerTable(); err != nil {
+		t.Fatalf("unexpected err, %s", err)
+	}
+	ev := nextEvent(t, sub)
+	if ev.Type != EventFingerUpdated || ev.New != vn.successors[0] || ev.FingerFrom != 0 || ev.FingerTo != 157 {
+		t.Fatalf("bad event %v", ev)
+	}
+
+	// Nothing changes the second time around
+	vn.last_finger = 0
+	vn.fixFingerTable()
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("unexpected event %v", ev)
+	default:
+	}
+}
+
+func TestSubscribeLeaving(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].predecessor = &r.vnodes[(i+num-1)%num].Vnode
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+	}
+	sub := r.Subscribe(16)
+
+	vn := r.vnodes[0]
+	vn.leave()
+	ev := nextEvent(t, sub)
+	if ev.Type != EventVnodeLeaving || ev.Vnode != &vn.Vnode || ev.Old != &r.vnodes[num-1].Vnode || ev.New != &r.vnodes[1].Vnode {
+		t.Fatalf("bad event %v", ev)
+	}
+}
+
+func TestSubscribeDropped(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	full := r.Subscribe(1)
+	other := r.Subscribe(4)
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn2.Notify(&vn1.Vnode)
+	vn2.ClearPredecessor(&vn1.Vnode)
+	vn2.Notify(&vn1.Vnode)
+
+	if full.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped, got %d", full.Dropped())
+	}
+	if other.Dropped() != 0 || len(other.C) != 3 {
+		t.Fatalf("other subscriber should get all events")
+	}
+
+	// Closing stops the subscription
+	full.Close()
+	<-full.C
+	if _, ok := <-full.C; ok {
+		t.Fatalf("expected closed channel")
+	}
+	if len(r.eventSubs) != 1 {
+		t.Fatalf("expected one subscriber left")
+	}
+}
+
+func TestSubscribeShutdown(t *testing.T) {
+	conf := fastConf()
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	sub := r.Subscribe(1)
+	r.Shutdown()
+	for range sub.C {
+	}
+	if _, ok := <-r.Subscribe(1).C; ok {
+		t.Fatalf("expected closed channel")
+	}
+}
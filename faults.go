@@ -0,0 +1,378 @@
+package chord
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Identifies the RPCs of a Transport
+type RPCType int
+
+const (
+	RPCListVnodes RPCType = iota
+	RPCPing
+	RPCGetPredecessor
+	RPCNotify
+	RPCFindSuccessors
+	RPCFindSuccessorsMany
+	RPCClearPredecessor
+	RPCSkipSuccessor
+	RPCHandshake
+	RPCLeaveHandover
+)
+
+func (t RPCType) String() string {
+	switch t {
+	case RPCListVnodes:
+		return "ListVnodes"
+	case RPCPing:
+		return "Ping"
+	case RPCGetPredecessor:
+		return "GetPredecessor"
+	case RPCNotify:
+		return "Notify"
+	case RPCFindSuccessors:
+		return "FindSuccessors"
+	case RPCFindSuccessorsMany:
+		return "FindSuccessorsMany"
+	case RPCClearPredecessor:
+		return "ClearPredecessor"
+	case RPCSkipSuccessor:
+		return "SkipSuccessor"
+	case RPCHandshake:
+		return "Handshake"
+	case RPCLeaveHandover:
+		return "LeaveHandover"
+	default:
+		return "Unknown"
+	}
+}
+
+// Returns a random latency
+type Latency func(r *rand.Rand) time.Duration
+
+// Always the same latency
+func FixedLatency(d time.Duration) Latency {
+	return func(*rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// Latency uniformly distributed in [min,max)
+func UniformLatency(min, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.Float64()*float64(max-min))
+	}
+}
+
+// Latency exponentially distributed around a mean, for long tails
+func ExponentialLatency(mean time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// Faults injected into the matching RPCs. Latencies block the caller, on
+// the wall clock unless the FaultNet sleeps otherwise.
+type Fault struct {
+	Latency       Latency       // Added to each call, nil for none
+	DropRate      float64       // Probability of losing the call
+	DropTimeout   time.Duration // Time a lost call waits before failing
+	ErrorRate     float64       // Probability of failing the call without running it
+	DuplicateRate float64       // Probability of delivering the call twice
+	ReorderRate   float64       // Probability of holding the call back
+	ReorderDelay  time.Duration // Time a held back call waits, so later calls overtake it
+}
+
+// A direction between two hosts, an empty host matches any host
+type Link struct {
+	From string
+	To   string
+}
+
+// Counts the injected faults
+type FaultStats struct {
+	Dropped    uint64
+	Failed     uint64
+	Duplicated uint64
+	Reordered  uint64
+	Blocked    uint64 // Calls across a partition
+}
+
+// A fault and the calls it applies to
+type faultRule struct {
+	link  Link
+	rpcs  []RPCType
+	fault *Fault
+}
+
+// Checks if the rule applies to a call
+func (r *faultRule) matches(from, to string, rpc RPCType) bool {
+	if (r.link.From != "" && r.link.From != from) || (r.link.To != "" && r.link.To != to) {
+		return false
+	}
+	if len(r.rpcs) == 0 {
+		return true
+	}
+	for _, t := range r.rpcs {
+		if t == rpc {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultNet wraps a transport shared by in-process nodes, and injects
+// faults into the calls between them. Each host uses its own view of the
+// network, returned by Transport. Faults are set per link and RPC type,
+// and the hosts can be split into partitions on demand.
+type FaultNet struct {
+	shared Transport
+	lock   sync.Mutex
+	rand   *rand.Rand
+	rules  []*faultRule
+	group  map[string]int
+	stats  FaultStats
+	sleep  func(time.Duration)
+}
+
+// Wraps a transport, drawing the faults from a seeded random source
+func NewFaultNet(trans Transport, seed int64) *FaultNet {
+	return &FaultNet{
+		shared: trans,
+		rand:   rand.New(rand.NewSource(seed)),
+		group:  make(map[string]int),
+		sleep:  time.Sleep,
+	}
+}
+
+// Replaces the function used to delay calls, for instance to advance a
+// VirtualClock so the other timers run during the latency
+func (n *FaultNet) SetSleep(sleep func(time.Duration)) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.sleep = sleep
+}
+
+// Returns the transport used by a host
+func (n *FaultNet) Transport(host string) Transport {
+	return &faultTransport{net: n, host: host}
+}
+
+// Injects a fault into the calls of the given RPC types over a link, or
+// of every type if none is given. The latest matching fault applies.
+func (n *FaultNet) SetFault(link Link, fault *Fault, rpcs ...RPCType) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.rules = append(n.rules, &faultRule{link: link, rpcs: rpcs, fault: fault})
+}
+
+// Removes all the faults
+func (n *FaultNet) ClearFaults() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.rules = nil
+}
+
+// Splits the hosts into groups that cannot reach each other. Hosts not
+// in any group form one more group.
+func (n *FaultNet) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.group = make(map[string]int)
+	for idx, hosts := range groups {
+		for _, host := range hosts {
+			n.group[host] = idx + 1
+		}
+	}
+}
+
+// Removes the partitions
+func (n *FaultNet) Heal() {
+	n.Partition()
+}
+
+// Returns the number of injected faults
+func (n *FaultNet) Stats() FaultStats {
+	return FaultStats{
+		Dropped:    atomic.LoadUint64(&n.stats.Dropped),
+		Failed:     atomic.LoadUint64(&n.stats.Failed),
+		Duplicated: atomic.LoadUint64(&n.stats.Duplicated),
+		Reordered:  atomic.LoadUint64(&n.stats.Reordered),
+		Blocked:    atomic.LoadUint64(&n.stats.Blocked),
+	}
+}
+
+// Checks if two hosts are in the same partition
+func (n *FaultNet) connected(a, b string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.group[a] == n.group[b]
+}
+
+// The faults drawn for a single call
+type faultDraw struct {
+	delay     time.Duration
+	drop      bool
+	fail      bool
+	duplicate bool
+}
+
+// Draws the faults of a call, and returns the sleep function to delay
+// it. Returns false if the hosts are partitioned.
+func (n *FaultNet) draw(from, to string, rpc RPCType) (faultDraw, func(time.Duration), bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var d faultDraw
+	if n.group[from] != n.group[to] {
+		return d, n.sleep, false
+	}
+
+	// Find the latest matching rule
+	var f *Fault
+	for i := len(n.rules) - 1; i >= 0; i-- {
+		if n.rules[i].matches(from, to, rpc) {
+			f = n.rules[i].fault
+			break
+		}
+	}
+	if f == nil {
+		return d, n.sleep, true
+	}
+
+	if f.Latency != nil {
+		d.delay = f.Latency(n.rand)
+	}
+	if n.rand.Float64() < f.ReorderRate {
+		d.delay += f.ReorderDelay
+		atomic.AddUint64(&n.stats.Reordered, 1)
+	}
+	if n.rand.Float64() < f.DropRate {
+		d.drop = true
+		d.delay += f.DropTimeout
+		atomic.AddUint64(&n.stats.Dropped, 1)
+	} else if n.rand.Float64() < f.ErrorRate {
+		d.fail = true
+		atomic.AddUint64(&n.stats.Failed, 1)
+	} else if n.rand.Float64() < f.DuplicateRate {
+		d.duplicate = true
+		atomic.AddUint64(&n.stats.Duplicated, 1)
+	}
+	return d, n.sleep, true
+}
+
+// The view of a FaultNet from one host
+type faultTransport struct {
+	net  *FaultNet
+	host string
+}
+
+// Makes a call to a host, injecting the faults. The call is invoked
+// twice when duplicated, the second result is kept.
+func (t *faultTransport) call(to string, rpc RPCType, f func() error) error {
+	d, sleep, ok := t.net.draw(t.host, to, rpc)
+	if !ok {
+		atomic.AddUint64(&t.net.stats.Blocked, 1)
+		return fmt.Errorf("Host %s is partitioned from %s!", to, t.host)
+	}
+	if d.delay > 0 {
+		sleep(d.delay)
+	}
+	if d.drop {
+		return fmt.Errorf("Dropped %s to %s!", rpc, to)
+	}
+	if d.fail {
+		return fmt.Errorf("Injected %s failure at %s!", rpc, to)
+	}
+	if d.duplicate {
+		f()
+	}
+	return f()
+}
+
+func (t *faultTransport) ListVnodes(host string) (res []*Vnode, err error) {
+	err = t.call(host, RPCListVnodes, func() error {
+		res, err = t.net.shared.ListVnodes(host)
+		return err
+	})
+	return
+}
+
+func (t *faultTransport) Ping(vn *Vnode) (ok bool, err error) {
+	// Vnodes across a partition look dead
+	if !t.net.connected(t.host, vn.Host) {
+		atomic.AddUint64(&t.net.stats.Blocked, 1)
+		return false, nil
+	}
+	err = t.call(vn.Host, RPCPing, func() error {
+		ok, err = t.net.shared.Ping(vn)
+		return err
+	})
+	return ok && err == nil, err
+}
+
+func (t *faultTransport) GetPredecessor(vn *Vnode) (res *Vnode, err error) {
+	err = t.call(vn.Host, RPCGetPredecessor, func() error {
+		res, err = t.net.shared.GetPredecessor(vn)
+		return err
+	})
+	return
+}
+
+func (t *faultTransport) Notify(target, self *Vnode) (res []*Vnode, err error) {
+	err = t.call(target.Host, RPCNotify, func() error {
+		res, err = t.net.shared.Notify(target, self)
+		return err
+	})
+	return
+}
+
+func (t *faultTransport) FindSuccessors(vn *Vnode, n int, key []byte, meta LookupMetaData) (resMeta LookupMetaData, res []*Vnode, err error) {
+	resMeta = meta
+	err = t.call(vn.Host, RPCFindSuccessors, func() error {
+		resMeta, res, err = t.net.shared.FindSuccessors(vn, n, key, meta)
+		return err
+	})
+	return
+}
+
+func (t *faultTransport) FindSuccessorsMany(vn *Vnode, n int, keys [][]byte) (res [][]*Vnode, err error) {
+	err = t.call(vn.Host, RPCFindSuccessorsMany, func() error {
+		res, err = findSuccessorsMany(t.net.shared, vn, n, keys)
+		return err
+	})
+	return
+}
+
+func (t *faultTransport) ClearPredecessor(target, self *Vnode) error {
+	return t.call(target.Host, RPCClearPredecessor, func() error {
+		return t.net.shared.ClearPredecessor(target, self)
+	})
+}
+
+func (t *faultTransport) SkipSuccessor(target, self *Vnode) error {
+	return t.call(target.Host, RPCSkipSuccessor, func() error {
+		return t.net.shared.SkipSuccessor(target, self)
+	})
+}
+
+func (t *faultTransport) Handshake(vn *Vnode, info *ClusterInfo) (res *ClusterInfo, err error) {
+	err = t.call(vn.Host, RPCHandshake, func() error {
+		res, err = t.net.shared.Handshake(vn, info)
+		return err
+	})
+	return
+}
+
+func (t *faultTransport) LeaveHandover(vn *Vnode, info *LeaveInfo) error {
+	return t.call(vn.Host, RPCLeaveHandover, func() error {
+		return t.net.shared.LeaveHandover(vn, info)
+	})
+}
+
+func (t *faultTransport) Register(vn *Vnode, o VnodeRPC) {
+	t.net.shared.Register(vn, o)
+}
@@ -0,0 +1,167 @@
+package chord
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Counts the notifications it receives
+type countingRPC struct {
+	*MockVnodeRPC
+	notified int
+}
+
+func (c *countingRPC) Notify(vn *Vnode) ([]*Vnode, error) {
+	c.notified++
+	return c.MockVnodeRPC.Notify(vn)
+}
+
+// Registers a vnode on host b of a fault net
+func makeFaultNet() (*FaultNet, *Vnode, *countingRPC) {
+	fn := NewFaultNet(InitLocalTransportFakeTcp(nil, nil), 1)
+	vn := &Vnode{Id: []byte{1}, Host: "b"}
+	rpc := &countingRPC{MockVnodeRPC: &MockVnodeRPC{pred: vn}}
+	fn.Transport("b").Register(vn, rpc)
+	return fn, vn, rpc
+}
+
+func TestLatencies(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	if d := FixedLatency(time.Second)(r); d != time.Second {
+		t.Fatalf("bad latency %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		d := UniformLatency(time.Second, 2*time.Second)(r)
+		if d < time.Second || d >= 2*time.Second {
+			t.Fatalf("bad latency %v", d)
+		}
+		if d := ExponentialLatency(time.Second)(r); d < 0 {
+			t.Fatalf("bad latency %v", d)
+		}
+	}
+}
+
+func TestFaultNetPartition(t *testing.T) {
+	fn, vn, _ := makeFaultNet()
+	a := fn.Transport("a")
+
+	fn.Partition([]string{"a"}, []string{"b"})
+	if alive, err := a.Ping(vn); alive || err != nil {
+		t.Fatalf("expected a dead vnode %v %v", alive, err)
+	}
+	if _, err := a.GetPredecessor(vn); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Hosts in the same group still reach each other
+	if alive, _ := fn.Transport("b").Ping(vn); !alive {
+		t.Fatalf("expected a live vnode")
+	}
+
+	fn.Heal()
+	if alive, err := a.Ping(vn); !alive || err != nil {
+		t.Fatalf("expected a live vnode %v %v", alive, err)
+	}
+	if s := fn.Stats(); s.Blocked != 2 {
+		t.Fatalf("bad stats %+v", s)
+	}
+}
+
+func TestFaultNetErrors(t *testing.T) {
+	fn, vn, _ := makeFaultNet()
+	fn.SetFault(Link{From: "a"}, &Fault{ErrorRate: 1}, RPCGetPredecessor)
+
+	if _, err := fn.Transport("a").GetPredecessor(vn); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Other RPC types and links are not affected
+	if alive, err := fn.Transport("a").Ping(vn); !alive || err != nil {
+		t.Fatalf("expected a live vnode %v %v", alive, err)
+	}
+	if pred, err := fn.Transport("c").GetPredecessor(vn); err != nil || pred != vn {
+		t.Fatalf("unexpected pred %v %v", pred, err)
+	}
+
+	// The latest fault applies
+	fn.SetFault(Link{From: "a", To: "b"}, &Fault{})
+	if _, err := fn.Transport("a").GetPredecessor(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	fn.ClearFaults()
+	if s := fn.Stats(); s.Failed != 1 {
+		t.Fatalf("bad stats %+v", s)
+	}
+}
+
+func TestFaultNetDrop(t *testing.T) {
+	fn, vn, rpc := makeFaultNet()
+	fn.SetFault(Link{}, &Fault{DropRate: 1, DropTimeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := fn.Transport("a").Notify(vn, vn); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("dropped call should time out")
+	}
+	if rpc.notified != 0 {
+		t.Fatalf("dropped call was delivered")
+	}
+}
+
+func TestFaultNetDuplicateReorder(t *testing.T) {
+	fn, vn, rpc := makeFaultNet()
+	fn.SetFault(Link{}, &Fault{DuplicateRate: 1, ReorderRate: 1, ReorderDelay: 20 * time.Millisecond,
+		Latency: FixedLatency(10 * time.Millisecond)}, RPCNotify)
+
+	start := time.Now()
+	if _, err := fn.Transport("a").Notify(vn, vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatalf("call should be delayed")
+	}
+	if rpc.notified != 2 {
+		t.Fatalf("expected a duplicate call, got %d", rpc.notified)
+	}
+	if s := fn.Stats(); s.Duplicated != 1 || s.Reordered != 1 {
+		t.Fatalf("bad stats %+v", s)
+	}
+}
+
+func TestFaultNetDeterministic(t *testing.T) {
+	run := func() FaultStats {
+		fn, vn, _ := makeFaultNet()
+		fn.SetFault(Link{}, &Fault{DropRate: 0.2, ErrorRate: 0.2, DuplicateRate: 0.2})
+		for i := 0; i < 100; i++ {
+			fn.Transport("a").GetPredecessor(vn)
+		}
+		return fn.Stats()
+	}
+	first := run()
+	if first.Dropped == 0 || first.Failed == 0 || first.Duplicated == 0 {
+		t.Fatalf("expected faults %+v", first)
+	}
+	if second := run(); second != first {
+		t.Fatalf("same seed gave different faults %+v %+v", first, second)
+	}
+}
+
+func TestFaultNetVirtualSleep(t *testing.T) {
+	fn, vn, _ := makeFaultNet()
+	clock := NewVirtualClock(time.Unix(0, 0))
+	fn.SetSleep(clock.Advance)
+	fn.SetFault(Link{}, &Fault{Latency: FixedLatency(time.Hour)})
+
+	// Timers due during the latency run meanwhile
+	ran := false
+	clock.AfterFunc(time.Minute, func() { ran = true })
+	if _, err := fn.Transport("a").GetPredecessor(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !ran || !clock.Now().Equal(time.Unix(0, 0).Add(time.Hour)) {
+		t.Fatalf("latency should advance the clock %v", clock.Now())
+	}
+}
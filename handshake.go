@@ -0,0 +1,92 @@
+package chord
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// Version of the Chord protocol, nodes only join rings of the same version
+const ProtocolVersion = 1
+
+// Describes the settings a node must share with the ring it joins
+type ClusterInfo struct {
+	Cluster       string // Name of the cluster
+	Version       int    // Protocol version
+	HashDigest    string // Digest of hashProbe, identifies the hash function
+	HashBits      int    // Bit size of the IDs
+	NumSuccessors int    // Number of successors maintained
+}
+
+// Returned by transports when the remote node does not know a request,
+// such as a node running a version without the join handshake
+var ErrUnknownRequest = fmt.Errorf("Unknown request type!")
+
+// Fixed input hashed to tell hash functions apart
+const hashProbe = "go-chord hash probe"
+
+// Returns the cluster information of a configuration
+func (c *Config) clusterInfo() *ClusterInfo {
+	h := c.HashFunc()
+	h.Write([]byte(hashProbe))
+	return &ClusterInfo{
+		Cluster:       c.ClusterName,
+		Version:       ProtocolVersion,
+		HashDigest:    hex.EncodeToString(h.Sum(nil)),
+		HashBits:      c.hashBits,
+		NumSuccessors: c.NumSuccessors,
+	}
+}
+
+// Checks if a remote node is compatible with the local one
+func (info *ClusterInfo) compatible(remote *ClusterInfo) error {
+	if remote == nil {
+		return fmt.Errorf("Missing cluster info!")
+	}
+	if remote.Cluster != info.Cluster {
+		return fmt.Errorf("Cluster name mismatch! Expected %q, got %q", info.Cluster, remote.Cluster)
+	}
+	if remote.Version != info.Version {
+		return fmt.Errorf("Protocol version mismatch! Expected %d, got %d", info.Version, remote.Version)
+	}
+	if remote.HashDigest != info.HashDigest {
+		return fmt.Errorf("Hash function mismatch! Expected probe digest %s, got %s", info.HashDigest, remote.HashDigest)
+	}
+	if remote.HashBits != info.HashBits {
+		return fmt.Errorf("ID width mismatch! Expected %d bits, got %d bits", info.HashBits, remote.HashBits)
+	}
+	if remote.NumSuccessors != info.NumSuccessors {
+		return fmt.Errorf("Successor count mismatch! Expected %d, got %d", info.NumSuccessors, remote.NumSuccessors)
+	}
+	return nil
+}
+
+// Exchanges cluster information with a remote vnode before joining.
+// Both sides check compatibility, the remote rejects the join first.
+// Nodes predating the handshake are joined without it, so that rings can
+// be upgraded one node at a time.
+func handshake(conf *Config, trans Transport, vn *Vnode) error {
+	local := conf.clusterInfo()
+	remote, err := trans.Handshake(vn, local)
+	if err == ErrUnknownRequest {
+		log.Printf("[ERR] %s does not support the join handshake, joining without it", vn.Host)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Join rejected by %s! Got %s", vn.Host, err)
+	}
+	if err := local.compatible(remote); err != nil {
+		return fmt.Errorf("Incompatible ring at %s! Got %s", vn.Host, err)
+	}
+	return nil
+}
+
+// Answers a handshake from a joining node, rejecting incompatible nodes
+func (vn *localVnode) Handshake(info *ClusterInfo) (*ClusterInfo, error) {
+	local := vn.ring.config.clusterInfo()
+	if err := local.compatible(info); err != nil {
+		log.Printf("[ERR] Rejected a joining node! Got %s", err)
+		return local, err
+	}
+	return local, nil
+}
@@ -0,0 +1,176 @@
+package chord
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/gob"
+	"hash"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClusterInfoCompatible(t *testing.T) {
+	conf := fastConf()
+	initHashBits(conf)
+	info := conf.clusterInfo()
+	if info.Version != ProtocolVersion || info.HashBits != 160 || info.HashDigest == "" {
+		t.Fatalf("bad info %v", info)
+	}
+	if err := info.compatible(conf.clusterInfo()); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := info.compatible(nil); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Every setting must match
+	changes := []func(*ClusterInfo){
+		func(i *ClusterInfo) { i.Cluster = "other" },
+		func(i *ClusterInfo) { i.Version++ },
+		func(i *ClusterInfo) { i.HashDigest = "other" },
+		func(i *ClusterInfo) { i.HashBits = 256 },
+		func(i *ClusterInfo) { i.NumSuccessors++ },
+	}
+	for idx, change := range changes {
+		remote := conf.clusterInfo()
+		change(remote)
+		if err := info.compatible(remote); err == nil {
+			t.Fatalf("expected err for change %d", idx)
+		}
+	}
+}
+
+func TestClusterInfoHash(t *testing.T) {
+	// Hashes of the same type and size are told apart
+	keyed := func(key string) func() hash.Hash {
+		return func() hash.Hash { return hmac.New(sha1.New, []byte(key)) }
+	}
+	conf := fastConf()
+	conf.HashFunc = keyed("a")
+	initHashBits(conf)
+	other := fastConf()
+	other.HashFunc = keyed("b")
+	initHashBits(other)
+	if err := conf.clusterInfo().compatible(other.clusterInfo()); err == nil {
+		t.Fatalf("expected err!")
+	}
+	other.HashFunc = keyed("a")
+	if err := conf.clusterInfo().compatible(other.clusterInfo()); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+}
+
+func TestJoinHandshake(t *testing.T) {
+	ml := InitMLTransport()
+	conf := fastConf()
+	conf.ClusterName = "prod"
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Another cluster is rejected
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.ClusterName = "dev"
+	if _, err := Join(conf2, ml, "test"); err == nil || !strings.Contains(err.Error(), "Cluster name mismatch") {
+		t.Fatalf("expected cluster err! Got %v", err)
+	}
+
+	// The same cluster joins
+	conf2.ClusterName = "prod"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	r.Shutdown()
+	r2.Shutdown()
+}
+
+func TestTCPHandshake(t *testing.T) {
+	c1, t1, err := prepRing(10033)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c2, t2, err := prepRing(10034)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// A different hash function is rejected by the remote node
+	c2.HashFunc = sha256.New
+	if _, err := Join(c2, t2, c1.Hostname); err == nil || !strings.Contains(err.Error(), "Join rejected") {
+		t.Fatalf("expected rejection! Got %v", err)
+	}
+
+	// So is a different successor count
+	c2.HashFunc = c1.HashFunc
+	c2.NumSuccessors = 4
+	if _, err := Join(c2, t2, c1.Hostname); err == nil || !strings.Contains(err.Error(), "Successor count mismatch") {
+		t.Fatalf("expected rejection! Got %v", err)
+	}
+
+	r1.Shutdown()
+	t1.Shutdown()
+	t2.Shutdown()
+}
+
+// A transport to nodes predating the handshake
+type legacyTransport struct{ Transport }
+
+func (legacyTransport) Handshake(*Vnode, *ClusterInfo) (*ClusterInfo, error) {
+	return nil, ErrUnknownRequest
+}
+
+func TestHandshakeLegacyPeer(t *testing.T) {
+	// Older nodes close the connection on request types they do not know
+	ln, err := net.Listen("tcp", "localhost:10039")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var header tcpHeader
+			gob.NewDecoder(conn).Decode(&header)
+			conn.Close()
+		}
+	}()
+	trans, err := InitTCPTransport("localhost:10040", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	conf := fastConf()
+	initHashBits(conf)
+	legacy := &Vnode{Id: []byte{1}, Host: "localhost:10039"}
+	if _, err := trans.Handshake(legacy, conf.clusterInfo()); err != ErrUnknownRequest {
+		t.Fatalf("expected unknown request! Got %v", err)
+	}
+
+	// Joining through such a node skips the handshake
+	ml := InitMLTransport()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, &legacyTransport{ml}, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	r.Shutdown()
+	r2.Shutdown()
+}
@@ -0,0 +1,150 @@
+package chord
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Maximum width of a ring ID, enough for SHA-512. Hash functions with a
+// wider output are rejected when creating or joining a ring.
+const MaxIDBits = 512
+
+// Number of 64bit words in an ID
+const idWords = MaxIDBits / 64
+
+// ID is a fixed width position on the ring. It holds the big endian
+// value of a Vnode ID as 64bit words, most significant word first,
+// so that comparisons and modular arithmetic never allocate.
+type ID [idWords]uint64
+
+// Converts a big endian byte slice into an ID. Slices wider than
+// MaxIDBits keep only their least significant bytes.
+func IDFromBytes(b []byte) ID {
+	var id ID
+	if len(b) > MaxIDBits/8 {
+		b = b[len(b)-MaxIDBits/8:]
+	}
+
+	// Fill whole words from the least significant end
+	w := idWords - 1
+	for len(b) >= 8 {
+		id[w] = binary.BigEndian.Uint64(b[len(b)-8:])
+		b = b[:len(b)-8]
+		w--
+	}
+
+	// Fill any remaining partial word
+	var last uint64
+	for _, c := range b {
+		last = last<<8 | uint64(c)
+	}
+	if len(b) > 0 {
+		id[w] = last
+	}
+	return id
+}
+
+// Returns the ID of a vnode
+func (vn *Vnode) ringID() ID {
+	return IDFromBytes(vn.Id)
+}
+
+// Returns the key of a vnode in maps. Unlike its ID, it keeps all the
+// bytes, so vnode IDs of different lengths never share a key.
+func (vn *Vnode) idKey() string {
+	return string(vn.Id)
+}
+
+// Returns the ID as a big endian byte slice wide enough for the given
+// number of bits
+func (id ID) Bytes(width int) []byte {
+	out := make([]byte, (width+7)/8)
+	for i := range out {
+		k := len(out) - 1 - i
+		out[i] = byte(id[idWords-1-k/8] >> (uint(k%8) * 8))
+	}
+	return out
+}
+
+// Compares two IDs, returning -1, 0 or 1
+func (id ID) Cmp(o ID) int {
+	for i := 0; i < idWords; i++ {
+		if id[i] < o[i] {
+			return -1
+		} else if id[i] > o[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Checks if the ID is strictly between a and b, going clockwise
+// around the ring
+func (id ID) between(a, b ID) bool {
+	// Check for ring wrap around
+	if a.Cmp(b) == 1 {
+		return a.Cmp(id) == -1 || b.Cmp(id) == 1
+	}
+	return a.Cmp(id) == -1 && b.Cmp(id) == 1
+}
+
+// Checks if the ID is between a and b going clockwise, right inclusive
+func (id ID) betweenRightIncl(a, b ID) bool {
+	// Check for ring wrap around
+	if a.Cmp(b) == 1 {
+		return a.Cmp(id) == -1 || b.Cmp(id) >= 0
+	}
+	return a.Cmp(id) == -1 && b.Cmp(id) >= 0
+}
+
+// Computes (id + o) % 2^width
+func (id ID) Add(o ID, width int) ID {
+	var sum ID
+	var carry uint64
+	for i := idWords - 1; i >= 0; i-- {
+		sum[i], carry = bits.Add64(id[i], o[i], carry)
+	}
+	return sum.mask(width)
+}
+
+// Computes (id - o) % 2^width, the forward distance from o to id
+func (id ID) Sub(o ID, width int) ID {
+	var diff ID
+	var borrow uint64
+	for i := idWords - 1; i >= 0; i-- {
+		diff[i], borrow = bits.Sub64(id[i], o[i], borrow)
+	}
+	return diff.mask(width)
+}
+
+// Formats the ID as hex, as wide as the given number of bits
+func (id ID) Hex(width int) string {
+	return fmt.Sprintf("%x", id.Bytes(width))
+}
+
+// Returns 2^exp as an ID
+func powerOfTwo(exp int) ID {
+	var id ID
+	if exp >= 0 && exp < MaxIDBits {
+		id[idWords-1-exp/64] = 1 << uint(exp%64)
+	}
+	return id
+}
+
+// Clears all the bits at or above the given width
+func (id ID) mask(width int) ID {
+	if width >= MaxIDBits {
+		return id
+	}
+	for i := 0; i < idWords; i++ {
+		// Number of bits of this word that fall below the width
+		low := width - (idWords-1-i)*64
+		if low <= 0 {
+			id[i] = 0
+		} else if low < 64 {
+			id[i] &= (1 << uint(low)) - 1
+		}
+	}
+	return id
+}
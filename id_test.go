@@ -0,0 +1,107 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"hash"
+	"math/big"
+	"testing"
+)
+
+func TestIDBytes(t *testing.T) {
+	h := sha1.New()
+	h.Write([]byte("test"))
+	b := h.Sum(nil)
+
+	id := IDFromBytes(b)
+	if out := id.Bytes(160); !bytes.Equal(out, b) {
+		t.Fatalf("bad round trip! %x %x", out, b)
+	}
+
+	id = IDFromBytes([]byte{1, 2, 3})
+	if id[idWords-1] != 0x010203 {
+		t.Fatalf("bad id %v", id)
+	}
+	if out := id.Bytes(32); !bytes.Equal(out, []byte{0, 1, 2, 3}) {
+		t.Fatalf("bad bytes %v", out)
+	}
+}
+
+func TestIDCmp(t *testing.T) {
+	a := IDFromBytes([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0})
+	b := IDFromBytes([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if a.Cmp(b) != 1 || b.Cmp(a) != -1 || a.Cmp(a) != 0 {
+		t.Fatalf("bad compare")
+	}
+}
+
+func TestIDAddWrap(t *testing.T) {
+	a := IDFromBytes([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	one := IDFromBytes([]byte{1})
+
+	// Carries into the next word
+	sum := a.Add(one, 72)
+	if out := sum.Bytes(72); !bytes.Equal(out, []byte{1, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad sum %v", out)
+	}
+
+	// Wraps around the ring
+	sum = a.Add(one, 64)
+	if sum != (ID{}) {
+		t.Fatalf("bad sum %v", sum)
+	}
+}
+
+func TestIDSub(t *testing.T) {
+	a := IDFromBytes([]byte{2})
+	b := IDFromBytes([]byte{5})
+	if d := b.Sub(a, 8); d != IDFromBytes([]byte{3}) {
+		t.Fatalf("bad diff %v", d)
+	}
+	if d := a.Sub(b, 8); d != IDFromBytes([]byte{253}) {
+		t.Fatalf("bad diff %v", d)
+	}
+}
+
+// Checks the ID arithmetic against math/big
+func TestIDMatchesBig(t *testing.T) {
+	for _, hashFunc := range []func() hash.Hash{sha1.New, sha512.New} {
+		h := hashFunc()
+		width := h.Size() * 8
+		ring := new(big.Int).Lsh(big.NewInt(1), uint(width))
+		for i := 0; i < 100; i++ {
+			h.Write([]byte{byte(i)})
+			a := h.Sum(nil)
+			h.Write([]byte{byte(i)})
+			b := h.Sum(nil)
+
+			var exp big.Int
+			exp.Sub(new(big.Int).SetBytes(b), new(big.Int).SetBytes(a))
+			exp.Mod(&exp, ring)
+			if d := distance(a, b, width); new(big.Int).SetBytes(d.Bytes(width)).Cmp(&exp) != 0 {
+				t.Fatalf("bad distance %x expected %x", d.Bytes(width), exp.Bytes())
+			}
+
+			exp.Add(new(big.Int).SetBytes(a), new(big.Int).Lsh(big.NewInt(1), uint(i*width/100)))
+			exp.Mod(&exp, ring)
+			if off := powerOffset(a, i*width/100, width); new(big.Int).SetBytes(off).Cmp(&exp) != 0 {
+				t.Fatalf("bad offset %x expected %x", off, exp.Bytes())
+			}
+		}
+	}
+}
+
+func BenchmarkDistance(b *testing.B) {
+	h := sha1.New()
+	h.Write([]byte("a"))
+	x := h.Sum(nil)
+	h.Write([]byte("b"))
+	y := h.Sum(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		distance(x, y, 160)
+	}
+}
@@ -1,23 +1,44 @@
 package chord
 
 import (
-	"math/big"
+	"bytes"
 )
 
 type closestPreceedingVnodeIterator struct {
 	key           []byte
+	keyID         ID
+	vnID          ID
 	vn            *localVnode
 	finger_idx    int
 	successor_idx int
-	yielded       map[string]struct{}
+	yielded       [][]byte
+	yieldedBuf    [8][]byte
 }
 
 func (cp *closestPreceedingVnodeIterator) init(vn *localVnode, key []byte) {
 	cp.key = key
+	cp.keyID = IDFromBytes(key)
+	cp.vnID = vn.ringID()
 	cp.vn = vn
 	cp.successor_idx = len(vn.successors) - 1
 	cp.finger_idx = len(vn.finger) - 1
-	cp.yielded = make(map[string]struct{})
+	cp.yielded = cp.yieldedBuf[:0]
+}
+
+// Checks if a node was already returned by the iterator
+func (cp *closestPreceedingVnodeIterator) wasYielded(vn *Vnode) bool {
+	for _, y := range cp.yielded {
+		if bytes.Equal(y, vn.Id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a node, marking it as yielded
+func (cp *closestPreceedingVnodeIterator) yield(vn *Vnode) *Vnode {
+	cp.yielded = append(cp.yielded, vn.Id)
+	return vn
 }
 
 func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
@@ -27,15 +48,16 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 
 	// Scan to find the next successor
 	vn := cp.vn
+	vn.lock.RLock()
 	var i int
 	for i = cp.successor_idx; i >= 0; i-- {
 		if vn.successors[i] == nil {
 			continue
 		}
-		if _, ok := cp.yielded[vn.successors[i].String()]; ok {
+		if cp.wasYielded(vn.successors[i]) {
 			continue
 		}
-		if between(vn.Id, cp.key, vn.successors[i].Id) {
+		if vn.successors[i].ringID().between(cp.vnID, cp.keyID) {
 			successor_node = vn.successors[i]
 			break
 		}
@@ -47,15 +69,16 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 		if vn.finger[i] == nil {
 			continue
 		}
-		if _, ok := cp.yielded[vn.finger[i].String()]; ok {
+		if cp.wasYielded(vn.finger[i]) {
 			continue
 		}
-		if between(vn.Id, cp.key, vn.finger[i].Id) {
+		if vn.finger[i].ringID().between(cp.vnID, cp.keyID) {
 			finger_node = vn.finger[i]
 			break
 		}
 	}
 	cp.finger_idx = i
+	vn.lock.RUnlock()
 
 	// Determine which node is better
 	if successor_node != nil && finger_node != nil {
@@ -68,18 +91,15 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 		} else {
 			cp.finger_idx--
 		}
-		cp.yielded[closest.String()] = struct{}{}
-		return closest
+		return cp.yield(closest)
 
 	} else if successor_node != nil {
 		cp.successor_idx--
-		cp.yielded[successor_node.String()] = struct{}{}
-		return successor_node
+		return cp.yield(successor_node)
 
 	} else if finger_node != nil {
 		cp.finger_idx--
-		cp.yielded[finger_node.String()] = struct{}{}
-		return finger_node
+		return cp.yield(finger_node)
 	}
 
 	return nil
@@ -97,21 +117,6 @@ func closest_preceeding_vnode(a, b *Vnode, key []byte, bits int) *Vnode {
 }
 
 // Computes the forward distance from a to b modulus a ring size
-func distance(a, b []byte, bits int) *big.Int {
-	// Get the ring size
-	var ring big.Int
-	ring.Exp(big.NewInt(2), big.NewInt(int64(bits)), nil)
-
-	// Convert to int
-	var a_int, b_int big.Int
-	(&a_int).SetBytes(a)
-	(&b_int).SetBytes(b)
-
-	// Compute the distances
-	var dist big.Int
-	(&dist).Sub(&b_int, &a_int)
-
-	// Distance modulus ring size
-	(&dist).Mod(&dist, &ring)
-	return &dist
+func distance(a, b []byte, bits int) ID {
+	return IDFromBytes(b).Sub(IDFromBytes(a), bits)
 }
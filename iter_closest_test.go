@@ -1,7 +1,7 @@
 package chord
 
 import (
-	"math/big"
+	"crypto/sha1"
 	"testing"
 )
 
@@ -163,21 +163,37 @@ func TestDistance(t *testing.T) {
 	a := []byte{63}
 	b := []byte{3}
 	d := distance(a, b, 6) // Ring size of 64
-	if d.Cmp(big.NewInt(4)) != 0 {
+	if d.Cmp(IDFromBytes([]byte{4})) != 0 {
 		t.Fatalf("expect distance 4! %v", d)
 	}
 
 	a = []byte{0}
 	b = []byte{65}
 	d = distance(a, b, 7) // Ring size of 128
-	if d.Cmp(big.NewInt(65)) != 0 {
+	if d.Cmp(IDFromBytes([]byte{65})) != 0 {
 		t.Fatalf("expect distance 65! %v", d)
 	}
 
 	a = []byte{1}
 	b = []byte{255}
 	d = distance(a, b, 8) // Ring size of 256
-	if d.Cmp(big.NewInt(254)) != 0 {
+	if d.Cmp(IDFromBytes([]byte{254})) != 0 {
 		t.Fatalf("expect distance 254! %v", d)
 	}
 }
+
+func BenchmarkClosest(b *testing.B) {
+	h := sha1.New()
+	h.Write([]byte("a"))
+	a := &Vnode{Id: h.Sum(nil)}
+	h.Write([]byte("b"))
+	c := &Vnode{Id: h.Sum(nil)}
+	h.Write([]byte("k"))
+	k := h.Sum(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		closest_preceeding_vnode(a, c, k, 160)
+	}
+}
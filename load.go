@@ -0,0 +1,216 @@
+package chord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math"
+	"sort"
+)
+
+// Returns the ID a node generates for its vnode of the given index
+func vnodeID(hashFunc func() hash.Hash, nodeName string, idx uint16) []byte {
+	h := hashFunc()
+	h.Write([]byte(nodeName))
+	binary.Write(h, binary.BigEndian, idx)
+	return h.Sum(nil)
+}
+
+// A node of a computed ring
+type RingMember struct {
+	Host     string // Host of the vnodes
+	NodeName string // Name hashed into the vnode IDs, defaults to Host
+}
+
+// Returns the name hashed into the vnode IDs of the member
+func (m RingMember) nodeName() string {
+	if m.NodeName != "" {
+		return m.NodeName
+	}
+	return m.Host
+}
+
+// Returns members whose node names default to their host names, like
+// nodes that do not set NodeName
+func HostMembers(hosts []string) []RingMember {
+	members := make([]RingMember, len(hosts))
+	for i, host := range hosts {
+		members[i] = RingMember{Host: host}
+	}
+	return members
+}
+
+// Returns the vnodes that the given members would create with the
+// NumVnodes and HashFunc of the config, without starting them. Each member
+// names its own node, so the NodeName of the config is not used. Hosts
+// and node names must be unique. Sorted by ID.
+func ComputeVnodes(conf *Config, members []RingMember) ([]*Vnode, error) {
+	hosts := make(map[string]bool, len(members))
+	names := make(map[string]bool, len(members))
+	for _, m := range members {
+		if m.Host == "" {
+			return nil, fmt.Errorf("Member has no host!")
+		}
+		if hosts[m.Host] {
+			return nil, fmt.Errorf("Duplicate host %s!", m.Host)
+		}
+		if names[m.nodeName()] {
+			return nil, fmt.Errorf("Duplicate node name %s!", m.nodeName())
+		}
+		hosts[m.Host] = true
+		names[m.nodeName()] = true
+	}
+
+	vnodes := make([]*Vnode, 0, len(members)*conf.NumVnodes)
+	for _, m := range members {
+		for i := 0; i < conf.NumVnodes; i++ {
+			vnodes = append(vnodes, &Vnode{Id: vnodeID(conf.HashFunc, m.nodeName(), uint16(i)), Host: m.Host})
+		}
+	}
+	sortVnodes(vnodes)
+	return vnodes, nil
+}
+
+// Sorts vnodes by ID
+func sortVnodes(vnodes []*Vnode) {
+	sort.Slice(vnodes, func(i, j int) bool {
+		return bytes.Compare(vnodes[i].Id, vnodes[j].Id) < 0
+	})
+}
+
+// The share of the load of a vnode
+type VnodeLoad struct {
+	Vnode *Vnode
+	Space float64 // Fraction of the hash space owned
+	Keys  int     // Number of sample keys owned
+}
+
+// The share of the load of a host, over all its vnodes
+type HostLoad struct {
+	Host   string
+	Vnodes int
+	Space  float64 // Fraction of the hash space owned
+	Keys   int     // Number of sample keys owned
+}
+
+// Spread of a load over vnodes or hosts
+type Imbalance struct {
+	Min         float64
+	Max         float64
+	Mean        float64
+	StdDev      float64
+	MaxOverMean float64 // Load of the busiest over the average, 1 when even
+}
+
+// How a ring spreads the hash space and a sample of keys over its vnodes
+// and hosts
+type LoadReport struct {
+	Vnodes     []VnodeLoad // Sorted by ID
+	Hosts      []HostLoad  // Sorted by host
+	SampleKeys int
+	VnodeSpace Imbalance
+	VnodeKeys  Imbalance
+	HostSpace  Imbalance
+	HostKeys   Imbalance
+}
+
+// Computes the load of the vnodes of a ring, either collected from a live
+// ring or from ComputeVnodes. Each vnode owns the IDs after its
+// predecessor up to its own ID. The sample keys are hashed with the
+// hash function of the ring.
+func AnalyzeLoad(vnodes []*Vnode, hashFunc func() hash.Hash, keys [][]byte) *LoadReport {
+	report := &LoadReport{SampleKeys: len(keys)}
+	if len(vnodes) == 0 {
+		return report
+	}
+	sorted := append([]*Vnode(nil), vnodes...)
+	sortVnodes(sorted)
+	bits := hashFunc().Size() * 8
+
+	// Share of the hash space, a lone vnode owns all of it
+	report.Vnodes = make([]VnodeLoad, len(sorted))
+	for i, vn := range sorted {
+		pred := sorted[(i+len(sorted)-1)%len(sorted)]
+		space := 1.0
+		if len(sorted) > 1 {
+			space = idFraction(distance(pred.Id, vn.Id, bits), bits)
+		}
+		report.Vnodes[i] = VnodeLoad{Vnode: vn, Space: space}
+	}
+
+	// Keys belong to the first vnode at or after their hash
+	for _, key := range keys {
+		h := hashFunc()
+		h.Write(key)
+		hash := h.Sum(nil)
+		idx := sort.Search(len(sorted), func(i int) bool {
+			return bytes.Compare(sorted[i].Id, hash) >= 0
+		})
+		report.Vnodes[idx%len(sorted)].Keys++
+	}
+
+	// Sum up per host
+	byHost := make(map[string]*HostLoad)
+	for _, l := range report.Vnodes {
+		hl, ok := byHost[l.Vnode.Host]
+		if !ok {
+			hl = &HostLoad{Host: l.Vnode.Host}
+			byHost[l.Vnode.Host] = hl
+		}
+		hl.Vnodes++
+		hl.Space += l.Space
+		hl.Keys += l.Keys
+	}
+	for _, hl := range byHost {
+		report.Hosts = append(report.Hosts, *hl)
+	}
+	sort.Slice(report.Hosts, func(i, j int) bool {
+		return report.Hosts[i].Host < report.Hosts[j].Host
+	})
+
+	var vnodeSpace, vnodeKeys, hostSpace, hostKeys []float64
+	for _, l := range report.Vnodes {
+		vnodeSpace = append(vnodeSpace, l.Space)
+		vnodeKeys = append(vnodeKeys, float64(l.Keys))
+	}
+	for _, hl := range report.Hosts {
+		hostSpace = append(hostSpace, hl.Space)
+		hostKeys = append(hostKeys, float64(hl.Keys))
+	}
+	report.VnodeSpace = imbalance(vnodeSpace)
+	report.VnodeKeys = imbalance(vnodeKeys)
+	report.HostSpace = imbalance(hostSpace)
+	report.HostKeys = imbalance(hostKeys)
+	return report
+}
+
+// Returns the ID as a fraction of a hash space of the given width
+func idFraction(id ID, bits int) float64 {
+	f := 0.0
+	for i := 0; i < idWords; i++ {
+		f = f*math.Exp2(64) + float64(id[i])
+	}
+	return math.Ldexp(f, -bits)
+}
+
+// Computes the spread of a non empty set of loads
+func imbalance(loads []float64) Imbalance {
+	im := Imbalance{Min: loads[0], Max: loads[0]}
+	sum := 0.0
+	for _, l := range loads {
+		im.Min = math.Min(im.Min, l)
+		im.Max = math.Max(im.Max, l)
+		sum += l
+	}
+	im.Mean = sum / float64(len(loads))
+	variance := 0.0
+	for _, l := range loads {
+		variance += (l - im.Mean) * (l - im.Mean)
+	}
+	im.StdDev = math.Sqrt(variance / float64(len(loads)))
+	if im.Mean > 0 {
+		im.MaxOverMean = im.Max / im.Mean
+	}
+	return im
+}
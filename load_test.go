@@ -0,0 +1,132 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestComputeVnodes(t *testing.T) {
+	conf := DefaultConfig("test")
+	ring := &Ring{}
+	ring.init(conf, nil)
+
+	vnodes, err := ComputeVnodes(conf, HostMembers([]string{"test"}))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(vnodes) != conf.NumVnodes {
+		t.Fatalf("bad vnode count %d", len(vnodes))
+	}
+	for _, vn := range ring.vnodes {
+		found := false
+		for _, other := range vnodes {
+			found = found || (bytes.Equal(vn.Id, other.Id) && other.Host == "test")
+		}
+		if !found {
+			t.Fatalf("missing vnode %s", vn.String())
+		}
+	}
+	for i := 1; i < len(vnodes); i++ {
+		if bytes.Compare(vnodes[i-1].Id, vnodes[i].Id) >= 0 {
+			t.Fatalf("vnodes not sorted")
+		}
+	}
+}
+
+func TestComputeVnodesNodeName(t *testing.T) {
+	conf := DefaultConfig("localhost:8000")
+	conf.NodeName = "node1"
+	ring := &Ring{}
+	ring.init(conf, nil)
+
+	// The IDs come from the node name, the vnodes carry the host
+	vnodes, err := ComputeVnodes(conf, []RingMember{{Host: "localhost:8000", NodeName: "node1"}})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for i, vn := range ring.vnodes {
+		found := false
+		for _, other := range vnodes {
+			found = found || (bytes.Equal(vn.Id, other.Id) && other.Host == "localhost:8000")
+		}
+		if !found {
+			t.Fatalf("missing vnode %d", i)
+		}
+	}
+
+	// Hosts and node names must be unique
+	dups := [][]RingMember{
+		{{Host: "a"}, {Host: "a", NodeName: "b"}},
+		{{Host: "a", NodeName: "n"}, {Host: "b", NodeName: "n"}},
+		{{Host: "a"}, {Host: "b", NodeName: "a"}},
+		{{NodeName: "a"}},
+	}
+	for _, members := range dups {
+		if _, err := ComputeVnodes(conf, members); err == nil {
+			t.Fatalf("expected err for %v", members)
+		}
+	}
+}
+
+func TestAnalyzeLoad(t *testing.T) {
+	// Two vnodes splitting the ring in halves
+	half := make([]byte, 20)
+	half[0] = 0x80
+	vnodes := []*Vnode{
+		{Id: half, Host: "b"},
+		{Id: make([]byte, 20), Host: "a"},
+	}
+	report := AnalyzeLoad(vnodes, sha1.New, nil)
+	if len(report.Hosts) != 2 || report.Hosts[0].Host != "a" {
+		t.Fatalf("bad hosts %+v", report.Hosts)
+	}
+	for _, hl := range report.Hosts {
+		if hl.Space != 0.5 || hl.Vnodes != 1 {
+			t.Fatalf("bad host load %+v", hl)
+		}
+	}
+	if report.HostSpace.MaxOverMean != 1 || report.HostSpace.StdDev != 0 {
+		t.Fatalf("bad imbalance %+v", report.HostSpace)
+	}
+
+	// A lone vnode owns everything
+	report = AnalyzeLoad(vnodes[:1], sha1.New, [][]byte{[]byte("key")})
+	if report.Vnodes[0].Space != 1 || report.Vnodes[0].Keys != 1 {
+		t.Fatalf("bad vnode load %+v", report.Vnodes[0])
+	}
+}
+
+func TestAnalyzeLoadComputed(t *testing.T) {
+	conf := DefaultConfig("")
+	var hosts []string
+	for i := 0; i < 10; i++ {
+		hosts = append(hosts, fmt.Sprintf("host-%d", i))
+	}
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	vnodes, err := ComputeVnodes(conf, HostMembers(hosts))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	report := AnalyzeLoad(vnodes, conf.HashFunc, keys)
+	if len(report.Vnodes) != 10*conf.NumVnodes || len(report.Hosts) != 10 {
+		t.Fatalf("bad report sizes")
+	}
+	space, owned := 0.0, 0
+	for _, hl := range report.Hosts {
+		space += hl.Space
+		owned += hl.Keys
+	}
+	if math.Abs(space-1) > 1e-9 || owned != len(keys) {
+		t.Fatalf("bad totals %v %v", space, owned)
+	}
+	if im := report.HostSpace; im.Max < im.Mean || im.Min > im.Mean || im.MaxOverMean < 1 {
+		t.Fatalf("bad imbalance %+v", im)
+	}
+}
@@ -0,0 +1,87 @@
+package chord
+
+import (
+	"bytes"
+)
+
+// Looks up our own ID through a random remembered peer or seed. Within a
+// single ring the lookup finds ourself. Finding another vnode closer than
+// our successor means the peer is in another ring, for instance after a
+// network partition healed. Adopting that vnode as successor merges the
+// rings, stabilization then zips them together.
+func (vn *localVnode) mergeRings() {
+	vn.merged = vn.ring.config.clock().Now()
+	hosts := append(vn.ring.rememberedPeers(), vn.ring.config.Seeds...)
+	if len(hosts) == 0 {
+		return
+	}
+	host := hosts[vn.ring.config.randIntn(len(hosts))]
+	if host == vn.Host {
+		return
+	}
+
+	// Ask a vnode of the peer for our successor
+	trans := vn.ring.transport
+	vns, err := trans.ListVnodes(host)
+	if err != nil {
+		return
+	}
+	var remote []*Vnode
+	for _, v := range hostVnodes(vns, host) {
+		if !vn.ring.IsLocal(v) {
+			remote = append(remote, v)
+		}
+	}
+	if len(remote) == 0 {
+		return
+	}
+	_, succs, err := trans.FindSuccessors(nearestVnodeToKey(remote, vn.Id), 1, vn.Id, NewLookupMetaData())
+	if err != nil || len(succs) == 0 || succs[0] == nil {
+		return
+	}
+	vn.adoptSuccessor(succs[0])
+}
+
+// Adopts a vnode as successor if it is closer than the current one.
+// Returns true if it was adopted.
+func (vn *localVnode) adoptSuccessor(other *Vnode) bool {
+	succ := vn.firstSuccessor()
+	if succ == nil || bytes.Equal(other.Id, vn.Id) {
+		return false
+	}
+	alone := bytes.Equal(succ.Id, vn.Id)
+	if !alone && !between(vn.Id, succ.Id, other.Id) {
+		return false
+	}
+	if alive, _ := vn.ring.transport.Ping(other); !alive {
+		return false
+	}
+
+	old := vn.snapshotSuccessors()
+	vn.prependSuccessor(other)
+	vn.publishSuccessors(old)
+	vn.ring.publish(Event{Type: EventRingMerged, Vnode: &vn.Vnode, Old: succ, New: other})
+	return true
+}
+
+// Returns the vnodes listed by a host. Transports shared by several
+// hosts list the vnodes of all of them, only those of the host are kept
+// then. A host dialed by another address than the one it advertises
+// lists none with that address, all its vnodes are kept.
+func hostVnodes(vns []*Vnode, host string) []*Vnode {
+	res := make([]*Vnode, 0, len(vns))
+	listed := make([]*Vnode, 0, len(vns))
+	for _, v := range vns {
+		if v == nil {
+			continue
+		}
+		listed = append(listed, v)
+		if v.Host == host {
+			res = append(res, v)
+		}
+	}
+	if len(res) == 0 {
+		return listed
+	}
+	return res
+}
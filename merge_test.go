@@ -0,0 +1,159 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Checks that each vnode's successor is the next vnode among the given
+// rings, and its predecessor the previous one
+func consistentRing(rings []*Ring) bool {
+	var all []*localVnode
+	for _, r := range rings {
+		all = append(all, r.vnodes...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i].Id, all[j].Id) < 0
+	})
+	num := len(all)
+	for i, vn := range all {
+		next := all[(i+1)%num]
+		prev := all[(i+num-1)%num]
+		if !sameVnode(vn.firstSuccessor(), &next.Vnode) || !sameVnode(vn.getPredecessor(), &prev.Vnode) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestVnodeAdoptSuccessor(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	sub := r.Subscribe(8)
+	vn := r.vnodes[0]
+	vn.successors[0] = &r.vnodes[2].Vnode
+
+	// Farther than the successor
+	if vn.adoptSuccessor(&r.vnodes[3].Vnode) {
+		t.Fatalf("should not adopt")
+	}
+
+	// Closer than the successor
+	if !vn.adoptSuccessor(&r.vnodes[1].Vnode) {
+		t.Fatalf("should adopt")
+	}
+	if vn.successors[0] != &r.vnodes[1].Vnode || vn.successors[1] != &r.vnodes[2].Vnode {
+		t.Fatalf("bad successors")
+	}
+	var ev Event
+	for ev = nextEvent(t, sub); ev.Type != EventRingMerged; ev = nextEvent(t, sub) {
+	}
+	if ev.Old != &r.vnodes[2].Vnode || ev.New != &r.vnodes[1].Vnode {
+		t.Fatalf("bad event %v", ev)
+	}
+
+	// Dead vnodes are not adopted
+	if vn.adoptSuccessor(&Vnode{Id: r.vnodes[1].Id[:1], Host: "dead"}) {
+		t.Fatalf("should not adopt")
+	}
+}
+
+func TestRingPartitionMerge(t *testing.T) {
+	fn := NewFaultNet(InitLocalTransportFakeTcp(nil, nil), 1)
+	conf := func(host string) *Config {
+		c := fastConf()
+		c.Hostname = host
+		c.NumVnodes = 4
+		c.MergeInterval = 30 * time.Millisecond
+		return c
+	}
+
+	// Build a ring of 4 nodes
+	r1, err := Create(conf("node1"), fn.Transport("node1"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	rings := []*Ring{r1}
+	for i := 2; i <= 4; i++ {
+		host := fmt.Sprintf("node%d", i)
+		r, err := Join(conf(host), fn.Transport(host), "node1")
+		if err != nil {
+			t.Fatalf("failed to join! Got %s", err)
+		}
+		rings = append(rings, r)
+	}
+	waitFor(t, "the ring to stabilize", func() bool { return consistentRing(rings) })
+
+	// Split into two rings
+	fn.Partition([]string{"node3", "node4"})
+	waitFor(t, "two rings", func() bool {
+		return consistentRing(rings[:2]) && consistentRing(rings[2:])
+	})
+
+	// Heal the partition, the rings merge back
+	fn.Heal()
+	waitFor(t, "the rings to merge", func() bool { return consistentRing(rings) })
+
+	for _, r := range rings {
+		r.Shutdown()
+	}
+}
+
+func TestHostVnodes(t *testing.T) {
+	vns := []*Vnode{{Id: []byte{1}, Host: "a"}, nil, {Id: []byte{2}, Host: "b"}}
+
+	// A shared transport lists several hosts
+	if res := hostVnodes(vns, "b"); len(res) != 1 || res[0] != vns[2] {
+		t.Fatalf("bad vnodes %v", res)
+	}
+
+	// A host dialed by another address lists its advertised one
+	if res := hostVnodes(vns[:2], "alias"); len(res) != 1 || res[0] != vns[0] {
+		t.Fatalf("bad vnodes %v", res)
+	}
+}
+
+// Lists the vnodes of a host under another address
+type aliasTransport struct {
+	Transport
+	alias, host string
+}
+
+func (a *aliasTransport) ListVnodes(host string) ([]*Vnode, error) {
+	if host == a.alias {
+		host = a.host
+	}
+	return a.Transport.ListVnodes(host)
+}
+
+func TestRingMergeSeedAlias(t *testing.T) {
+	ml := InitMLTransport()
+	conf := func(host string) *Config {
+		c := fastConf()
+		c.Hostname = host
+		c.NumVnodes = 4
+		c.MergeInterval = 30 * time.Millisecond
+		return c
+	}
+
+	// Two separate rings, the seed of the first one is an alias of the
+	// second node
+	c1 := conf("node1")
+	c1.Seeds = []string{"alias"}
+	r1, err := Create(c1, &aliasTransport{ml, "alias", "node2"})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := Create(conf("node2"), ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	rings := []*Ring{r1, r2}
+	waitFor(t, "the rings to merge", func() bool { return consistentRing(rings) })
+
+	r1.Shutdown()
+	r2.Shutdown()
+}
@@ -3,6 +3,7 @@ package chord
 import (
 	"encoding/gob"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -19,19 +20,37 @@ using the GOB format for simplicity.
 
 Internally, there is 1 Goroutine listening for inbound connections, 1 Goroutine PER
 inbound connection.
+
+Several independent rings can share one TCPTransport, and so one port, by
+using a namespace per ring. Every request carries the namespace of the
+sending ring, and only reaches the vnodes registered in that namespace.
 */
 type TCPTransport struct {
+	*tcpShared
+	namespace string
+	derived   bool  // Created by Namespace
+	closed    int32 // Set once a derived namespace is shut down
+}
+
+// State shared by all the namespaces of a TCPTransport
+type tcpShared struct {
 	sock     *net.TCPListener
 	timeout  time.Duration
 	maxIdle  time.Duration
 	lock     sync.RWMutex
-	local    map[string]*localRPC
+	local    map[tcpKey]*localRPC
 	inbound  map[*net.TCPConn]struct{}
 	poolLock sync.Mutex
 	pool     map[string][]*tcpOutConn
 	shutdown int32
 }
 
+// Identifies a local vnode within its namespace
+type tcpKey struct {
+	namespace string
+	id        string
+}
+
 type tcpOutConn struct {
 	host   string
 	sock   *net.TCPConn
@@ -49,10 +68,14 @@ const (
 	tcpFindSucReq
 	tcpClearPredReq
 	tcpSkipSucReq
+	tcpFindSucManyReq
+	tcpHandshakeReq
+	tcpLeaveReq
 )
 
 type tcpHeader struct {
-	ReqType int
+	ReqType   int
+	Namespace string
 }
 
 // Potential body types
@@ -75,6 +98,11 @@ type tcpBodyFindSuc struct {
 	Key    []byte
 	Meta   LookupMetaData
 }
+type tcpBodyFindSucMany struct {
+	Target *Vnode
+	Num    int
+	Keys   [][]byte
+}
 type tcpBodyVnodeError struct {
 	Vnode *Vnode
 	Err   error
@@ -84,6 +112,22 @@ type tcpBodyVnodeListError struct {
 	Vnodes []*Vnode
 	Err    error
 }
+type tcpBodyVnodeListsError struct {
+	Vnodes [][]*Vnode
+	Err    error
+}
+type tcpBodyHandshake struct {
+	Target *Vnode
+	Info   *ClusterInfo
+}
+type tcpBodyHandshakeResp struct {
+	Info *ClusterInfo
+	Err  string // Sent as a string, so rejections reach the joining node
+}
+type tcpBodyLeave struct {
+	Target *Vnode
+	Info   *LeaveInfo
+}
 type tcpBodyBoolError struct {
 	B   bool
 	Err error
@@ -99,7 +143,7 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	}
 
 	// allocate maps
-	local := make(map[string]*localRPC)
+	local := make(map[tcpKey]*localRPC)
 	inbound := make(map[*net.TCPConn]struct{})
 	pool := make(map[string][]*tcpOutConn)
 
@@ -107,12 +151,13 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	maxIdle := time.Duration(300 * time.Second)
 
 	// Setup the transport
-	tcp := &TCPTransport{sock: sock.(*net.TCPListener),
+	shared := &tcpShared{sock: sock.(*net.TCPListener),
 		timeout: timeout,
 		maxIdle: maxIdle,
 		local:   local,
 		inbound: inbound,
 		pool:    pool}
+	tcp := &TCPTransport{tcpShared: shared}
 
 	// Listen for connections
 	go tcp.listen()
@@ -124,9 +169,20 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	return tcp, nil
 }
 
-// Checks for a local vnode
-func (t *TCPTransport) get(vn *Vnode) (VnodeRPC, bool) {
-	key := vn.String()
+// Returns a transport for another ring, sharing the listener and the
+// connections. Shutting it down only removes the namespace, shutting
+// down the transport it came from shuts down all the namespaces. The
+// name must not be empty, which is the namespace of the root transport.
+func (t *TCPTransport) Namespace(name string) (*TCPTransport, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Namespace name must not be empty!")
+	}
+	return &TCPTransport{tcpShared: t.tcpShared, namespace: name, derived: true}, nil
+}
+
+// Checks for a local vnode in a namespace
+func (t *TCPTransport) get(namespace string, vn *Vnode) (VnodeRPC, bool) {
+	key := tcpKey{namespace, vn.idKey()}
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 	w, ok := t.local[key]
@@ -142,7 +198,7 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 	// Check if we have a conn cached
 	var out *tcpOutConn
 	t.poolLock.Lock()
-	if atomic.LoadInt32(&t.shutdown) == 1 {
+	if atomic.LoadInt32(&t.shutdown) == 1 || atomic.LoadInt32(&t.closed) == 1 {
 		t.poolLock.Unlock()
 		return nil, fmt.Errorf("TCP transport is shutdown")
 	}
@@ -156,6 +212,7 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 	if out != nil {
 		// Verify that the socket is valid. Might be closed.
 		if _, err := out.sock.Read(nil); err == nil {
+			out.header.Namespace = t.namespace
 			return out, nil
 		}
 	}
@@ -177,6 +234,7 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 
 	// Wrap the sock
 	out = &tcpOutConn{host: host, sock: sock, enc: enc, dec: dec, used: now}
+	out.header.Namespace = t.namespace
 	return out, nil
 }
 
@@ -456,6 +514,56 @@ func (t *TCPTransport) FindSuccessors(vn *Vnode, n int, k []byte, meta LookupMet
 	}
 }
 
+// Find the successors of many keys
+func (t *TCPTransport) FindSuccessorsMany(vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	// Get a conn
+	out, err := t.getConn(vn.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan [][]*Vnode, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Send a list command
+		out.header.ReqType = tcpFindSucManyReq
+		body := tcpBodyFindSucMany{Target: vn, Num: n, Keys: keys}
+		if err := out.enc.Encode(&out.header); err != nil {
+			errChan <- err
+			return
+		}
+		if err := out.enc.Encode(&body); err != nil {
+			errChan <- err
+			return
+		}
+
+		// Read in the response
+		resp := tcpBodyVnodeListsError{}
+		if err := out.dec.Decode(&resp); err != nil {
+			errChan <- err
+			return
+		}
+
+		// Return the connection
+		t.returnConn(out)
+		if resp.Err == nil {
+			respChan <- resp.Vnodes
+		} else {
+			errChan <- resp.Err
+		}
+	}()
+
+	select {
+	case <-time.After(t.timeout):
+		return nil, fmt.Errorf("Command timed out!")
+	case err := <-errChan:
+		return nil, err
+	case res := <-respChan:
+		return res, nil
+	}
+}
+
 // Clears a predecessor if it matches a given vnode. Used to leave.
 func (t *TCPTransport) ClearPredecessor(target, self *Vnode) error {
 	// Get a conn
@@ -556,16 +664,133 @@ func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
 	}
 }
 
+// Exchanges cluster information with a node. Used to join.
+func (t *TCPTransport) Handshake(vn *Vnode, info *ClusterInfo) (*ClusterInfo, error) {
+	// Get a conn
+	out, err := t.getConn(vn.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan *ClusterInfo, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Send a handshake command
+		out.header.ReqType = tcpHandshakeReq
+		body := tcpBodyHandshake{Target: vn, Info: info}
+		if err := out.enc.Encode(&out.header); err != nil {
+			errChan <- err
+			return
+		}
+		if err := out.enc.Encode(&body); err != nil {
+			errChan <- err
+			return
+		}
+
+		// Read in the response. Older nodes close the connection on
+		// request types they do not know.
+		resp := tcpBodyHandshakeResp{}
+		if err := out.dec.Decode(&resp); err == io.EOF {
+			errChan <- ErrUnknownRequest
+			return
+		} else if err != nil {
+			errChan <- err
+			return
+		}
+
+		// Return the connection
+		t.returnConn(out)
+		if resp.Err == "" {
+			respChan <- resp.Info
+		} else {
+			errChan <- fmt.Errorf("%s", resp.Err)
+		}
+	}()
+
+	select {
+	case <-time.After(t.timeout):
+		return nil, fmt.Errorf("Command timed out!")
+	case err := <-errChan:
+		return nil, err
+	case res := <-respChan:
+		return res, nil
+	}
+}
+
+// Hands over the neighbors of a leaving vnode. Used to leave.
+func (t *TCPTransport) LeaveHandover(target *Vnode, info *LeaveInfo) error {
+	// Get a conn
+	out, err := t.getConn(target.Host)
+	if err != nil {
+		return err
+	}
+
+	respChan := make(chan bool, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Send a leave command
+		out.header.ReqType = tcpLeaveReq
+		body := tcpBodyLeave{Target: target, Info: info}
+		if err := out.enc.Encode(&out.header); err != nil {
+			errChan <- err
+			return
+		}
+		if err := out.enc.Encode(&body); err != nil {
+			errChan <- err
+			return
+		}
+
+		// Read in the response
+		resp := tcpBodyError{}
+		if err := out.dec.Decode(&resp); err != nil {
+			errChan <- err
+			return
+		}
+
+		// Return the connection
+		t.returnConn(out)
+		if resp.Err == nil {
+			respChan <- true
+		} else {
+			errChan <- resp.Err
+		}
+	}()
+
+	select {
+	case <-time.After(t.timeout):
+		return fmt.Errorf("Command timed out!")
+	case err := <-errChan:
+		return err
+	case <-respChan:
+		return nil
+	}
+}
+
 // Register for an RPC callbacks
 func (t *TCPTransport) Register(v *Vnode, o VnodeRPC) {
-	key := v.String()
+	key := tcpKey{t.namespace, v.idKey()}
 	t.lock.Lock()
 	t.local[key] = &localRPC{v, o}
 	t.lock.Unlock()
 }
 
-// Shutdown the TCP transport
+// Shutdown the TCP transport, including all its namespaces. A transport
+// returned by Namespace only unregisters the vnodes of its namespace and
+// stops sending, the listener and connections stay open for the others.
 func (t *TCPTransport) Shutdown() {
+	if t.derived {
+		atomic.StoreInt32(&t.closed, 1)
+		t.lock.Lock()
+		for key := range t.local {
+			if key.namespace == t.namespace {
+				delete(t.local, key)
+			}
+		}
+		t.lock.Unlock()
+		return
+	}
 	atomic.StoreInt32(&t.shutdown, 1)
 	t.sock.Close()
 
@@ -657,7 +882,9 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 	header := tcpHeader{}
 	var sendResp interface{}
 	for {
-		// Get the header
+		// Get the header. Reset it first, since gob does not transmit
+		// zero values and a ping would inherit the last request type.
+		header = tcpHeader{}
 		if err := dec.Decode(&header); err != nil {
 			if atomic.LoadInt32(&t.shutdown) == 0 && err.Error() != "EOF" {
 				log.Printf("[ERR] Failed to decode TCP header! Got %s", err)
@@ -675,7 +902,7 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			_, ok := t.get(body.Vn)
+			_, ok := t.get(header.Namespace, body.Vn)
 			if ok {
 				sendResp = tcpBodyBoolError{B: ok, Err: nil}
 			} else {
@@ -695,8 +922,10 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 
 			// Build list
 			t.lock.RLock()
-			for _, v := range t.local {
-				res = append(res, v.vnode)
+			for key, v := range t.local {
+				if key.namespace == header.Namespace {
+					res = append(res, v.vnode)
+				}
 			}
 			t.lock.RUnlock()
 
@@ -711,7 +940,7 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := t.get(header.Namespace, body.Vn)
 			resp := tcpBodyVnodeError{}
 			sendResp = &resp
 			if ok {
@@ -731,7 +960,7 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := t.get(header.Namespace, body.Target)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
 			if ok {
@@ -751,10 +980,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := t.get(header.Namespace, body.Target)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
-			if ok {
+			if err := checkNumSuccessors(body.Num); err != nil {
+				resp.Err = err
+			} else if ok {
 				meta, nodes, err := obj.FindSuccessors(body.Num, body.Key, body.Meta)
 				resp.Vnodes = trimSlice(nodes)
 				resp.Meta = meta
@@ -764,6 +995,31 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 					body.Target.Host, body.Target.String())
 			}
 
+		case tcpFindSucManyReq:
+			body := tcpBodyFindSucMany{}
+			if err := dec.Decode(&body); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+
+			// Generate a response
+			obj, ok := t.get(header.Namespace, body.Target)
+			resp := tcpBodyVnodeListsError{}
+			sendResp = &resp
+			if err := checkNumSuccessors(body.Num); err != nil {
+				resp.Err = err
+			} else if ok {
+				lists, err := vnodeFindSuccessorsMany(obj, body.Num, body.Keys)
+				for i := range lists {
+					lists[i] = trimSlice(lists[i])
+				}
+				resp.Vnodes = lists
+				resp.Err = err
+			} else {
+				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
+					body.Target.Host, body.Target.String())
+			}
+
 		case tcpClearPredReq:
 			body := tcpBodyTwoVnode{}
 			if err := dec.Decode(&body); err != nil {
@@ -772,7 +1028,7 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := t.get(header.Namespace, body.Target)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -790,7 +1046,7 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := t.get(header.Namespace, body.Target)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -800,6 +1056,46 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 					body.Target.Host, body.Target.String())
 			}
 
+		case tcpLeaveReq:
+			body := tcpBodyLeave{}
+			if err := dec.Decode(&body); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+
+			// Generate a response
+			obj, ok := t.get(header.Namespace, body.Target)
+			resp := tcpBodyError{}
+			sendResp = &resp
+			if ok {
+				resp.Err = obj.LeaveHandover(body.Info)
+			} else {
+				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
+					body.Target.Host, body.Target.String())
+			}
+
+		case tcpHandshakeReq:
+			body := tcpBodyHandshake{}
+			if err := dec.Decode(&body); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+
+			// Generate a response
+			obj, ok := t.get(header.Namespace, body.Target)
+			resp := tcpBodyHandshakeResp{}
+			sendResp = &resp
+			if ok {
+				info, err := obj.Handshake(body.Info)
+				resp.Info = info
+				if err != nil {
+					resp.Err = err.Error()
+				}
+			} else {
+				resp.Err = fmt.Sprintf("Target VN not found! Target %s:%s",
+					body.Target.Host, body.Target.String())
+			}
+
 		default:
 			log.Printf("[ERR] Unknown request type! Got %d", header.ReqType)
 			return
@@ -812,17 +1108,3 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		}
 	}
 }
-
-// Trims the slice to remove nil elements
-func trimSlice(vn []*Vnode) []*Vnode {
-	if vn == nil {
-		return vn
-	}
-
-	// Find a non-nil index
-	idx := len(vn) - 1
-	for vn[idx] == nil {
-		idx--
-	}
-	return vn[:idx+1]
-}
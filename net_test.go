@@ -7,11 +7,15 @@ import (
 )
 
 func prepRing(port int) (*Config, *TCPTransport, error) {
+	return prepRingTimeout(port, time.Duration(20*time.Millisecond))
+}
+
+// Prepares a node whose transport waits up to timeout for each request
+func prepRingTimeout(port int, timeout time.Duration) (*Config, *TCPTransport, error) {
 	listen := fmt.Sprintf("localhost:%d", port)
 	conf := DefaultConfig(listen)
 	conf.StabilizeMin = time.Duration(15 * time.Millisecond)
 	conf.StabilizeMax = time.Duration(45 * time.Millisecond)
-	timeout := time.Duration(20 * time.Millisecond)
 	trans, err := InitTCPTransport(listen, timeout)
 	if err != nil {
 		return nil, nil, err
@@ -90,3 +94,256 @@ func TestTCPLeave(t *testing.T) {
 		}
 	}
 }
+
+func TestTCPMeta(t *testing.T) {
+	// Prepare to create 2 nodes with metadata
+	c1, t1, err := prepRingTimeout(10029, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c1.Meta = map[string]string{"zone": "a"}
+	c2, t2, err := prepRingTimeout(10030, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c2.Meta = map[string]string{"zone": "b"}
+	zones := map[string]string{c1.Hostname: "a", c2.Hostname: "b"}
+
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := Join(c2, t2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	rings := []*Ring{r1, r2}
+	waitFor(t, "the ring to stabilize", func() bool { return consistentRing(rings) })
+
+	// Advertised when listing vnodes
+	vns, err := t2.ListVnodes(c1.Hostname)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, vn := range vns {
+		if vn.Meta["zone"] != "a" {
+			t.Fatalf("bad meta %v", vn.Meta)
+		}
+	}
+
+	// Returned with lookup results
+	for _, k := range []string{"test", "foo", "bar", "baz"} {
+		vns, err := r1.Lookup(3, []byte(k))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		for _, vn := range vns {
+			if vn.Meta["zone"] != zones[vn.Host] {
+				t.Fatalf("bad meta for %s: %v", vn.Host, vn.Meta)
+			}
+		}
+	}
+
+	// Config changes after creation are not advertised
+	c1.Meta["zone"] = "c"
+	if r1.vnodes[0].Meta["zone"] != "a" {
+		t.Fatalf("meta should be copied")
+	}
+
+	r1.Shutdown()
+	r2.Shutdown()
+	t1.Shutdown()
+	t2.Shutdown()
+}
+
+func TestTCPAdvertise(t *testing.T) {
+	// Listen on the loopback IP, advertise the loopback name
+	conf := DefaultConfig("localhost:10031")
+	conf.BindAddr = "127.0.0.1:10031"
+	conf.NodeName = "node1"
+	conf.StabilizeMin = time.Duration(15 * time.Millisecond)
+	conf.StabilizeMax = time.Duration(45 * time.Millisecond)
+	t1, err := InitTCPTransport(conf.ListenAddr(), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c2, t2, err := prepRingTimeout(10032, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	r1, err := Create(conf, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := Join(c2, t2, conf.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	rings := []*Ring{r1, r2}
+	waitFor(t, "the ring to stabilize", func() bool { return consistentRing(rings) })
+
+	// Other nodes know the first by its advertised address
+	vns, err := t2.ListVnodes(conf.Hostname)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, vn := range vns {
+		if vn.Host != "localhost:10031" {
+			t.Fatalf("bad host %s", vn.Host)
+		}
+	}
+
+	r1.Shutdown()
+	r2.Shutdown()
+	t1.Shutdown()
+	t2.Shutdown()
+}
+
+func TestTCPNamespaces(t *testing.T) {
+	// Two hosts, each running rings "a" and "b" on one port
+	t1, err := InitTCPTransport("localhost:10035", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	t2, err := InitTCPTransport("localhost:10036", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf := func(host, ring string) *Config {
+		c := DefaultConfig(host)
+		c.StabilizeMin = time.Duration(15 * time.Millisecond)
+		c.StabilizeMax = time.Duration(45 * time.Millisecond)
+		c.Meta = map[string]string{"ring": ring}
+		return c
+	}
+	namespace := func(trans *TCPTransport, name string) *TCPTransport {
+		ns, err := trans.Namespace(name)
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		return ns
+	}
+
+	// The empty name is the root namespace
+	if _, err := t1.Namespace(""); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// The rings on a host use the same vnode IDs
+	var rings []*Ring
+	for _, name := range []string{"a", "b"} {
+		r1, err := Create(conf("localhost:10035", name), namespace(t1, name))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		r2, err := Join(conf("localhost:10036", name), namespace(t2, name), "localhost:10035")
+		if err != nil {
+			t.Fatalf("failed to join local node! Got %s", err)
+		}
+		rings = append(rings, r1, r2)
+	}
+	<-time.After(100 * time.Millisecond)
+
+	// Listing only returns the vnodes of the namespace
+	vns, err := namespace(t2, "a").ListVnodes("localhost:10035")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(vns) != 8 {
+		t.Fatalf("bad number of vnodes %d", len(vns))
+	}
+	vns, err = t2.ListVnodes("localhost:10035")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(vns) != 0 {
+		t.Fatalf("default namespace should be empty")
+	}
+
+	// Lookups stay within a ring
+	for idx, r := range rings {
+		name := []string{"a", "b"}[idx/2]
+		for _, k := range []string{"test", "foo", "bar", "baz"} {
+			res, err := r.Lookup(3, []byte(k))
+			if err != nil {
+				t.Fatalf("unexpected err. %s", err)
+			}
+			for _, vn := range res {
+				if vn.Meta["ring"] != name {
+					t.Fatalf("lookup on ring %s reached %v", name, vn.Meta)
+				}
+			}
+		}
+	}
+
+	// Shutting down a namespace leaves the others running
+	rings[2].Shutdown()
+	rings[3].Shutdown()
+	b1 := namespace(t1, "b")
+	b1.Shutdown()
+	if _, err := b1.ListVnodes("localhost:10036"); err == nil {
+		t.Fatalf("expected err!")
+	}
+	vns, err = namespace(t2, "b").ListVnodes("localhost:10035")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(vns) != 0 {
+		t.Fatalf("namespace b should be empty")
+	}
+	if _, err := rings[1].Lookup(3, []byte("test")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	rings[0].Shutdown()
+	rings[1].Shutdown()
+	t1.Shutdown()
+	t2.Shutdown()
+}
+
+func TestTCPFindSuccessorsNum(t *testing.T) {
+	t1, err := InitTCPTransport("localhost:10037", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	t2, err := InitTCPTransport("localhost:10038", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r, err := Create(DefaultConfig("localhost:10037"), t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vn := &r.vnodes[0].Vnode
+	keys := [][]byte{[]byte("test"), []byte("foo")}
+
+	// A remote peer cannot ask for less than one successor
+	for _, n := range []int{0, -1} {
+		if _, _, err := t2.FindSuccessors(vn, n, keys[0], NewLookupMetaData()); err == nil {
+			t.Fatalf("expected err for %d successors", n)
+		}
+		if _, err := t2.FindSuccessorsMany(vn, n, keys); err == nil {
+			t.Fatalf("expected err for %d successors", n)
+		}
+	}
+
+	// Asking for more than known returns the known ones
+	_, res, err := t2.FindSuccessors(vn, 100, keys[0], NewLookupMetaData())
+	if err != nil || len(res) == 0 || len(res) > r.config.NumSuccessors {
+		t.Fatalf("bad result %v %v", res, err)
+	}
+	lists, err := t2.FindSuccessorsMany(vn, 100, keys)
+	if err != nil || len(lists) != len(keys) {
+		t.Fatalf("bad result %v %v", lists, err)
+	}
+	for _, l := range lists {
+		if len(l) == 0 || len(l) > r.config.NumSuccessors {
+			t.Fatalf("bad successors %v", l)
+		}
+	}
+
+	r.Shutdown()
+	t1.Shutdown()
+	t2.Shutdown()
+}
@@ -0,0 +1,303 @@
+/*
+Package proxy provides an http.Handler that routes each request to the
+node owning a key extracted from the request. Requests for keys owned by
+the local node are served locally, all others are proxied to the owning
+node. If the owner is unreachable, the next successors are tried in turn.
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-chord"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Header counting the times a request was proxied. Requests are routed
+// whatever its value, it only bounds loops while the ring is converging.
+// It is removed before requests are served locally.
+const ForwardedHeader = "X-Chord-Forwarded"
+
+// Extracts the routing key from a request
+type KeyFunc func(*http.Request) ([]byte, error)
+
+// Uses the value of a header as the key
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) ([]byte, error) {
+		v := r.Header.Get(name)
+		if v == "" {
+			return nil, fmt.Errorf("Missing header %s", name)
+		}
+		return []byte(v), nil
+	}
+}
+
+// Uses the value of a query parameter as the key
+func QueryKey(name string) KeyFunc {
+	return func(r *http.Request) ([]byte, error) {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return nil, fmt.Errorf("Missing query parameter %s", name)
+		}
+		return []byte(v), nil
+	}
+}
+
+// Uses a segment of the URL path as the key, counting from zero.
+// For example segment 1 of "/users/42/profile" is "42".
+func PathSegmentKey(idx int) KeyFunc {
+	return func(r *http.Request) ([]byte, error) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if idx >= len(segments) || segments[idx] == "" {
+			return nil, fmt.Errorf("Missing path segment %d", idx)
+		}
+		return []byte(segments[idx]), nil
+	}
+}
+
+// Configuration for the proxy handler
+type Config struct {
+	Ring        *chord.Ring               // Ring used for lookups, its vnodes are served locally
+	Key         KeyFunc                   // Extracts the key from requests
+	Local       http.Handler              // Serves the requests for keys owned locally
+	ServiceAddr func(*chord.Vnode) string // Maps a vnode to its service address
+	Successors  int                       // Number of successors to try, at most NumSuccessors
+	MaxHops     int                       // Number of times a request may be proxied before failing, 0 for 3
+	MaxBodySize int64                     // Largest request body accepted, 0 for 10MB
+	RetrySize   int64                     // Largest request body buffered to try the successors, 0 for 1MB
+	Transport   http.RoundTripper         // Transport used to proxy, nil for the default
+}
+
+// Uses a metadata value of the vnode as the service address, falling
+// back to the Chord host address if it is not set
+func MetaServiceAddr(key string) func(*chord.Vnode) string {
+	return func(vn *chord.Vnode) string {
+		if addr := vn.Meta[key]; addr != "" {
+			return addr
+		}
+		return vn.Host
+	}
+}
+
+// Returns a default configuration, proxying to the address in the
+// "http" metadata of the owner
+func DefaultConfig(ring *chord.Ring, key KeyFunc, local http.Handler) *Config {
+	return &Config{
+		Ring:        ring,
+		Key:         key,
+		Local:       local,
+		ServiceAddr: MetaServiceAddr("http"),
+		Successors:  3,
+		MaxHops:     defaultMaxHops,
+		MaxBodySize: defaultMaxBodySize,
+		RetrySize:   defaultRetrySize,
+	}
+}
+
+// Number of proxy hops allowed when MaxHops is not set
+const defaultMaxHops = 3
+
+// Returns the number of proxy hops allowed
+func (c *Config) maxHops() int {
+	if c.MaxHops <= 0 {
+		return defaultMaxHops
+	}
+	return c.MaxHops
+}
+
+// Body sizes used when MaxBodySize and RetrySize are not set
+const (
+	defaultMaxBodySize = 10 << 20
+	defaultRetrySize   = 1 << 20
+)
+
+// Returns the largest request body accepted
+func (c *Config) maxBodySize() int64 {
+	if c.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+// Returns the largest request body buffered for retries
+func (c *Config) retrySize() int64 {
+	if c.RetrySize <= 0 {
+		return defaultRetrySize
+	}
+	return c.RetrySize
+}
+
+// Handler routes requests to the node owning their key
+type Handler struct {
+	conf    *Config
+	lock    sync.Mutex
+	proxies map[string]*httputil.ReverseProxy // By service address
+}
+
+// Creates a new proxy handler
+func NewHandler(conf *Config) *Handler {
+	return &Handler{conf: conf, proxies: make(map[string]*httputil.ReverseProxy)}
+}
+
+// Context key holding where a proxy stores the error of a request
+type proxyErrKey struct{}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conf := h.conf
+
+	// Bound the number of hops, the header cannot skip the routing
+	hops := 0
+	if v := r.Header.Get(ForwardedHeader); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Bad %s header", ForwardedHeader), http.StatusBadRequest)
+			return
+		}
+		hops = n
+	}
+	if hops > conf.maxHops() {
+		http.Error(w, "Too many proxy hops", http.StatusLoopDetected)
+		return
+	}
+
+	// Find the owner of the key
+	key, err := conf.Key(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	succs, err := conf.Ring.Lookup(conf.Successors, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to lookup key! Got %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Limit the body, and buffer it if it is small enough to be retried
+	if r.ContentLength > conf.maxBodySize() {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, conf.maxBodySize())
+	}
+	getBody, err := retryBody(r, conf.retrySize())
+	if err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	// Try the owner, then each successor on a different host. Bodies that
+	// are not buffered are streamed to the owner only.
+	failed := make(map[string]struct{})
+	for _, vn := range succs {
+		body := r.Body
+		if getBody != nil {
+			if body, err = getBody(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if conf.Ring.IsLocal(vn) {
+			r.Body = body
+			r.Header.Del(ForwardedHeader)
+			conf.Local.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := failed[vn.Host]; ok {
+			continue
+		}
+		if hops == conf.maxHops() {
+			http.Error(w, "Too many proxy hops", http.StatusLoopDetected)
+			return
+		}
+
+		err := h.forward(w, r, conf.ServiceAddr(vn), body, hops+1)
+		if err == nil {
+			return
+		}
+		log.Printf("[ERR] Failed to proxy to %s. Got %s", vn.Host, err)
+		if getBody == nil {
+			http.Error(w, "Failed to stream the request to the owner of key", bodyErrorStatus(err, http.StatusBadGateway))
+			return
+		}
+		failed[vn.Host] = struct{}{}
+	}
+	http.Error(w, "No reachable owner for key", http.StatusBadGateway)
+}
+
+// Returns the status of a request whose body could not be read or sent,
+// the given one unless the body was too large
+func bodyErrorStatus(err error, status int) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return status
+}
+
+// Returns a function returning a new copy of the body for each attempt,
+// or nil if the body can only be read once. Bodies of an unknown length
+// or larger than the limit are not buffered.
+func retryBody(r *http.Request, limit int64) (func() (io.ReadCloser, error), error) {
+	if r.GetBody != nil {
+		return r.GetBody, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() (io.ReadCloser, error) { return http.NoBody, nil }, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > limit {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}, nil
+}
+
+// Proxies the request to an address as its given hop. Returns an error
+// if the request could not be sent, in which case nothing was written.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, addr string, body io.ReadCloser, hop int) error {
+	var proxyErr error
+	out := r.WithContext(context.WithValue(r.Context(), proxyErrKey{}, &proxyErr))
+	out.Header = r.Header.Clone()
+	out.Header.Set(ForwardedHeader, strconv.Itoa(hop))
+	out.Body = body
+	h.reverseProxy(addr).ServeHTTP(w, out)
+	return proxyErr
+}
+
+// Returns the reverse proxy to an address, creating it on first use
+func (h *Handler) reverseProxy(addr string) *httputil.ReverseProxy {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if rp, ok := h.proxies[addr]; ok {
+		return rp
+	}
+	rp := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = addr
+		},
+		Transport: h.conf.Transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if p, ok := r.Context().Value(proxyErrKey{}).(*error); ok {
+				*p = err
+			}
+		},
+	}
+	h.proxies[addr] = rp
+	return rp
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"go-chord"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func fastConf(host string) *chord.Config {
+	conf := chord.DefaultConfig(host)
+	conf.StabilizeMin = time.Duration(15 * time.Millisecond)
+	conf.StabilizeMax = time.Duration(45 * time.Millisecond)
+	return conf
+}
+
+// Serves the name of the node handling the request
+func nameHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	})
+}
+
+func get(t *testing.T, url string) (int, string) {
+	return getHeader(t, url, "", "")
+}
+
+// Sends a GET request with a header, unless the name is empty
+func getHeader(t *testing.T, url, name, value string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if name != "" {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestMetaServiceAddr(t *testing.T) {
+	addr := MetaServiceAddr("http")
+	vn := &chord.Vnode{Host: "node1:8000", Meta: map[string]string{"http": "node1:80"}}
+	if a := addr(vn); a != "node1:80" {
+		t.Fatalf("bad addr %s", a)
+	}
+	vn.Meta = nil
+	if a := addr(vn); a != "node1:8000" {
+		t.Fatalf("bad addr %s", a)
+	}
+}
+
+func TestKeyFuncs(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users/42/profile?id=7", nil)
+	r.Header.Set("X-Key", "abc")
+
+	if k, err := HeaderKey("X-Key")(r); err != nil || string(k) != "abc" {
+		t.Fatalf("bad header key %s %v", k, err)
+	}
+	if k, err := QueryKey("id")(r); err != nil || string(k) != "7" {
+		t.Fatalf("bad query key %s %v", k, err)
+	}
+	if k, err := PathSegmentKey(1)(r); err != nil || string(k) != "42" {
+		t.Fatalf("bad path key %s %v", k, err)
+	}
+
+	if _, err := HeaderKey("X-Missing")(r); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if _, err := QueryKey("missing")(r); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if _, err := PathSegmentKey(5)(r); err == nil {
+		t.Fatalf("expected err!")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// Each node advertises the address of its HTTP server
+	s1 := httptest.NewUnstartedServer(nil)
+	s2 := httptest.NewUnstartedServer(nil)
+	c1 := fastConf("node1")
+	c1.Meta = map[string]string{"http": s1.Listener.Addr().String()}
+	c2 := fastConf("node2")
+	c2.Meta = map[string]string{"http": s2.Listener.Addr().String()}
+
+	// Two nodes sharing an in-process transport
+	trans := chord.InitLocalTransportFakeTcp(nil, nil)
+	r1, err := chord.Create(c1, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := chord.Join(c2, trans, "node1")
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Each node runs a proxy in front of its local handler
+	conf1 := DefaultConfig(r1, QueryKey("key"), nameHandler("node1"))
+	conf2 := DefaultConfig(r2, QueryKey("key"), nameHandler("node2"))
+	h1 := NewHandler(conf1)
+	s1.Config.Handler = h1
+	s2.Config.Handler = NewHandler(conf2)
+	s1.Start()
+	s2.Start()
+
+	// Requests are served by the owner, whichever node receives them
+	owners := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		vns, err := r1.Lookup(1, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		owners[vns[0].Host] = true
+		for _, s := range []*httptest.Server{s1, s2} {
+			code, body := get(t, s.URL+"/?key="+key)
+			if code != http.StatusOK || body != vns[0].Host {
+				t.Fatalf("key %s served by %s (%d), owned by %s", key, body, code, vns[0].Host)
+			}
+		}
+	}
+	if len(owners) != 2 {
+		t.Fatalf("expected keys on both nodes")
+	}
+	if len(h1.proxies) != 1 {
+		t.Fatalf("expected a single cached proxy, got %d", len(h1.proxies))
+	}
+
+	// The forwarded header does not skip the routing
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		vns, _ := r1.Lookup(1, []byte(key))
+		for _, hops := range []string{"0", "2"} {
+			code, body := getHeader(t, s1.URL+"/?key="+key, ForwardedHeader, hops)
+			if code != http.StatusOK || body != vns[0].Host {
+				t.Fatalf("key %s served by %s (%d), owned by %s", key, body, code, vns[0].Host)
+			}
+		}
+	}
+	if code, _ := getHeader(t, s1.URL+"/?key=key-0", ForwardedHeader, "4"); code != http.StatusLoopDetected {
+		t.Fatalf("bad status %d", code)
+	}
+	if code, _ := getHeader(t, s1.URL+"/?key=key-0", ForwardedHeader, "node2"); code != http.StatusBadRequest {
+		t.Fatalf("bad status %d", code)
+	}
+
+	// Missing keys are rejected
+	if code, _ := get(t, s1.URL+"/"); code != http.StatusBadRequest {
+		t.Fatalf("bad status %d", code)
+	}
+
+	// Falls back to the successors when node2 is unreachable
+	s2.Close()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		code, body := get(t, s1.URL+"/?key="+key)
+		if code != http.StatusOK || body != "node1" {
+			t.Fatalf("key %s served by %s (%d)", key, body, code)
+		}
+	}
+
+	r1.Shutdown()
+	r2.Shutdown()
+	s1.Close()
+}
+
+// Serves the name of the node and the size of the request body
+func bodyHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s:%d", name, len(body))
+	})
+}
+
+// Posts a body of the given size, streamed with an unknown length if asked
+func post(t *testing.T, url string, size int, stream bool) (int, string) {
+	var body io.Reader = bytes.NewReader(make([]byte, size))
+	if stream {
+		body = ioutil.NopCloser(body)
+	}
+	resp, err := http.Post(url, "application/octet-stream", body)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer resp.Body.Close()
+	out, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(out)
+}
+
+func TestProxyBody(t *testing.T) {
+	s1 := httptest.NewUnstartedServer(nil)
+	s2 := httptest.NewUnstartedServer(nil)
+	c1 := fastConf("node1")
+	c1.Meta = map[string]string{"http": s1.Listener.Addr().String()}
+	c2 := fastConf("node2")
+	c2.Meta = map[string]string{"http": s2.Listener.Addr().String()}
+	trans := chord.InitLocalTransportFakeTcp(nil, nil)
+	r1, err := chord.Create(c1, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := chord.Join(c2, trans, "node1")
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conf1 := DefaultConfig(r1, QueryKey("key"), bodyHandler("node1"))
+	conf1.MaxBodySize = 1000
+	conf1.RetrySize = 100
+	s1.Config.Handler = NewHandler(conf1)
+	s2.Config.Handler = NewHandler(DefaultConfig(r2, QueryKey("key"), bodyHandler("node2")))
+	s1.Start()
+	s2.Start()
+
+	// Find a key owned by node2
+	var key string
+	for i := 0; key == ""; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		if vns, _ := r1.Lookup(1, []byte(k)); vns[0].Host == "node2" {
+			key = k
+		}
+	}
+	url := s1.URL + "/?key=" + key
+
+	// Small bodies are buffered, larger ones streamed, too large rejected
+	for _, stream := range []bool{false, true} {
+		for _, size := range []int{0, 50, 500} {
+			want := fmt.Sprintf("node2:%d", size)
+			if code, body := post(t, url, size, stream); code != http.StatusOK || body != want {
+				t.Fatalf("bad response to %d bytes (%v), %d %s", size, stream, code, body)
+			}
+		}
+		if code, _ := post(t, url, 2000, stream); code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("bad status %d", code)
+		}
+	}
+
+	// Only buffered bodies fall back to the successors
+	s2.Close()
+	if code, body := post(t, url, 50, false); code != http.StatusOK || body != "node1:50" {
+		t.Fatalf("bad response %d %s", code, body)
+	}
+	if code, _ := post(t, url, 500, false); code != http.StatusBadGateway {
+		t.Fatalf("bad status %d", code)
+	}
+
+	r1.Shutdown()
+	r2.Shutdown()
+	s1.Close()
+}
@@ -0,0 +1,97 @@
+package chord
+
+import (
+	"bytes"
+)
+
+// A range of the hash space owned by a local vnode. The vnode is
+// responsible for the IDs in (Predecessor, Owner].
+type OwnedRange struct {
+	Owner       *Vnode // Local vnode owning the range
+	Predecessor *Vnode // Start of the range, exclusive. Nil if not yet known
+}
+
+// Checks if an ID falls in the range. Always false if the
+// predecessor is not known. A vnode that is its own predecessor
+// is alone on the ring and owns everything.
+func (o OwnedRange) Contains(id []byte) bool {
+	if o.Predecessor == nil {
+		return false
+	}
+	if bytes.Equal(o.Predecessor.Id, o.Owner.Id) {
+		return true
+	}
+	return betweenRightIncl(o.Predecessor.Id, o.Owner.Id, id)
+}
+
+// Describes a change of the range owned by a local vnode
+type RangeChange struct {
+	Range OwnedRange // The new range
+	Old   *Vnode     // Previous predecessor, nil if it was not known
+}
+
+// Returns the range owned by each of the local vnodes
+func (r *Ring) OwnedRanges() []OwnedRange {
+	ranges := make([]OwnedRange, len(r.vnodes))
+	for idx, vn := range r.vnodes {
+		ranges[idx] = OwnedRange{Owner: &vn.Vnode, Predecessor: vn.getPredecessor()}
+	}
+	return ranges
+}
+
+// Checks if one of the local vnodes owns a key, based on the
+// ranges given by their currently known predecessors. A vnode whose
+// predecessor is not known yet owns nothing, so no node may own a key
+// until the next stabilization.
+func (r *Ring) OwnsKey(key []byte) bool {
+	h := r.config.HashFunc()
+	h.Write(key)
+	id := h.Sum(nil)
+	for _, rng := range r.OwnedRanges() {
+		if rng.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a vnode is one of the local vnodes. Vnodes carry the
+// advertised address of their node as host.
+func (r *Ring) IsLocal(vn *Vnode) bool {
+	for _, local := range r.vnodes {
+		if vn.Host == local.Host && bytes.Equal(vn.Id, local.Id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribes to changes of the ranges owned by the local vnodes, which
+// happen whenever a predecessor changes, leaves or is cleared. Changes
+// are buffered up to the given size, if a subscriber falls behind
+// further changes are dropped and it should resync using OwnedRanges.
+// The channel is closed when the ring shuts down.
+func (r *Ring) SubscribeRanges(buffer int) <-chan RangeChange {
+	ch := make(chan RangeChange, buffer)
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	if r.subsClosed {
+		close(ch)
+	} else {
+		r.rangeSubs = append(r.rangeSubs, ch)
+	}
+	return ch
+}
+
+// Stops delivering range changes to the channel and closes it
+func (r *Ring) UnsubscribeRanges(ch <-chan RangeChange) {
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	for idx, sub := range r.rangeSubs {
+		if sub == ch {
+			close(sub)
+			r.rangeSubs = append(r.rangeSubs[:idx], r.rangeSubs[idx+1:]...)
+			return
+		}
+	}
+}
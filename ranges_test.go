@@ -0,0 +1,143 @@
+package chord
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOwnedRanges(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].predecessor = &r.vnodes[(i+num-1)%num].Vnode
+	}
+
+	ranges := r.OwnedRanges()
+	if len(ranges) != num {
+		t.Fatalf("bad number of ranges %d", len(ranges))
+	}
+	for i, rng := range ranges {
+		if rng.Owner != &r.vnodes[i].Vnode {
+			t.Fatalf("bad owner")
+		}
+		if !rng.Contains(rng.Owner.Id) {
+			t.Fatalf("range should contain owner")
+		}
+		if rng.Contains(rng.Predecessor.Id) {
+			t.Fatalf("range should not contain predecessor")
+		}
+	}
+
+	// Unknown predecessor contains nothing
+	r.vnodes[0].predecessor = nil
+	if r.OwnedRanges()[0].Contains(r.vnodes[0].Id) {
+		t.Fatalf("range should be empty")
+	}
+}
+
+func TestSubscribeRanges(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	ch := r.SubscribeRanges(4)
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+
+	// New predecessor
+	vn3.Notify(&vn1.Vnode)
+	change := <-ch
+	if change.Range.Owner != &vn3.Vnode || change.Range.Predecessor != &vn1.Vnode || change.Old != nil {
+		t.Fatalf("bad change %v", change)
+	}
+
+	// Same predecessor, no change
+	vn3.Notify(&vn1.Vnode)
+
+	// Closer predecessor
+	vn3.Notify(&vn2.Vnode)
+	change = <-ch
+	if change.Range.Predecessor != &vn2.Vnode || change.Old != &vn1.Vnode {
+		t.Fatalf("bad change %v", change)
+	}
+
+	// Predecessor leaving
+	vn3.ClearPredecessor(&vn2.Vnode)
+	change = <-ch
+	if change.Range.Predecessor != nil || change.Old != &vn2.Vnode {
+		t.Fatalf("bad change %v", change)
+	}
+
+	select {
+	case c := <-ch:
+		t.Fatalf("unexpected change %v", c)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Unsubscribe closes the channel
+	r.UnsubscribeRanges(ch)
+	if _, ok := <-ch; ok {
+		t.Fatalf("expected closed channel")
+	}
+}
+
+func TestSubscribeRangesShutdown(t *testing.T) {
+	conf := fastConf()
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	ch := r.SubscribeRanges(1)
+	r.Shutdown()
+	for range ch {
+	}
+
+	// Subscribing after shutdown gets a closed channel
+	if _, ok := <-r.SubscribeRanges(1); ok {
+		t.Fatalf("expected closed channel")
+	}
+}
+
+func TestOwnsKey(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+
+	// Nothing is owned until the predecessors are known
+	if r.OwnsKey([]byte("test")) {
+		t.Fatalf("should not own key")
+	}
+
+	// Owns everything once the local ring is complete
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].predecessor = &r.vnodes[(i+num-1)%num].Vnode
+	}
+	for _, k := range []string{"test", "foo", "bar"} {
+		if !r.OwnsKey([]byte(k)) {
+			t.Fatalf("should own key %s", k)
+		}
+	}
+
+	// A vnode that is its own predecessor owns everything
+	rng := OwnedRange{Owner: &r.vnodes[0].Vnode, Predecessor: &r.vnodes[0].Vnode}
+	if !rng.Contains(r.vnodes[3].Id) {
+		t.Fatalf("expected id in range")
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	r := makeRing()
+	for _, vn := range r.vnodes {
+		if !r.IsLocal(&Vnode{Id: vn.Id, Host: vn.Host}) {
+			t.Fatalf("expected local vnode %s", vn.String())
+		}
+	}
+	if r.IsLocal(&Vnode{Id: r.vnodes[0].Id, Host: "other"}) {
+		t.Fatalf("vnode of another host is not local")
+	}
+	if r.IsLocal(&Vnode{Id: []byte{1}, Host: r.vnodes[0].Host}) {
+		t.Fatalf("unknown vnode is not local")
+	}
+}
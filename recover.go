@@ -0,0 +1,220 @@
+package chord
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Maximum number of remembered peer hosts
+const maxPeers = 64
+
+// Remembers the remote hosts seen on the ring, to recover from. Hosts are
+// refreshed whenever they are seen again, once full the host not seen
+// for the longest time is forgotten, so dead hosts age out.
+type peers struct {
+	peerLock  sync.Mutex
+	peerHosts map[string]*list.Element
+	peerLRU   *list.List // Front is the most recently seen
+}
+
+// Remembers a remote host, up to maxPeers of them
+func (p *peers) rememberPeer(host string) {
+	p.peerLock.Lock()
+	defer p.peerLock.Unlock()
+	if p.peerHosts == nil {
+		p.peerHosts = make(map[string]*list.Element)
+		p.peerLRU = list.New()
+	}
+	if elem, ok := p.peerHosts[host]; ok {
+		p.peerLRU.MoveToFront(elem)
+		return
+	}
+	p.peerHosts[host] = p.peerLRU.PushFront(host)
+	if p.peerLRU.Len() > maxPeers {
+		oldest := p.peerLRU.Back()
+		p.peerLRU.Remove(oldest)
+		delete(p.peerHosts, oldest.Value.(string))
+	}
+}
+
+// Returns the remembered hosts
+func (p *peers) rememberedPeers() []string {
+	p.peerLock.Lock()
+	defer p.peerLock.Unlock()
+	hosts := make([]string, 0, len(p.peerHosts))
+	for host := range p.peerHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Checks if any local vnode is isolated from the rest of the ring
+func (r *Ring) Isolated() bool {
+	for _, vn := range r.vnodes {
+		if vn.isIsolated() {
+			return true
+		}
+	}
+	return false
+}
+
+// Re-bootstraps a vnode that lost all its successors. The vnode first
+// falls back to the other local vnodes, so it always has a successor,
+// then asks the vnodes in the node cache and finger table, the
+// remembered peers and the configured seeds for its successors. Without
+// any answer the vnode is isolated until a later stabilization recovers.
+func (vn *localVnode) recoverSuccessors() error {
+	vn.setSuccessors(vn.localSuccessors())
+	if succs := vn.findRemoteSuccessors(); len(succs) > 0 {
+		vn.setSuccessors(succs)
+		vn.setIsolated(false)
+		return nil
+	}
+	if vn.isIsolated() {
+		return nil
+	}
+	vn.setIsolated(true)
+	return fmt.Errorf("All known successors dead! Isolated until a peer is reachable")
+}
+
+// Returns the local vnodes following this one
+func (vn *localVnode) localSuccessors() []*Vnode {
+	vnodes := vn.ring.vnodes
+	num := len(vnodes)
+	idx := 0
+	for i, local := range vnodes {
+		if local == vn {
+			idx = i
+		}
+	}
+	res := make([]*Vnode, 0, num)
+	for i := 1; i < num && len(res) < len(vn.successors); i++ {
+		res = append(res, &vnodes[(idx+i)%num].Vnode)
+	}
+	if len(res) == 0 {
+		res = append(res, &vn.Vnode)
+	}
+	return res
+}
+
+// Looks for our successors through any remote vnode or host we know of
+func (vn *localVnode) findRemoteSuccessors() []*Vnode {
+	// Try the vnodes we know of
+	var candidates []*Vnode
+	if vn.nodeCache != nil {
+		candidates = append(candidates, vn.nodeCache.vnodes()...)
+	}
+	vn.lock.RLock()
+	candidates = append(candidates, vn.finger...)
+	vn.lock.RUnlock()
+	for _, c := range candidates {
+		if c == nil || c.Host == vn.Host {
+			continue
+		}
+		if succs := vn.successorsVia(c); len(succs) > 0 {
+			return succs
+		}
+	}
+
+	// Try the hosts we know of
+	trans := vn.ring.transport
+	hosts := append(vn.ring.rememberedPeers(), vn.ring.config.Seeds...)
+	for _, host := range hosts {
+		if host == vn.Host {
+			continue
+		}
+		vns, err := trans.ListVnodes(host)
+		if err != nil {
+			continue
+		}
+		vns = remoteVnodes(vns, vn.Host)
+		if len(vns) == 0 {
+			continue
+		}
+		if succs := vn.successorsVia(nearestVnodeToKey(vns, vn.Id)); len(succs) > 0 {
+			return succs
+		}
+	}
+	return nil
+}
+
+// Filters out the vnodes of a host
+func remoteVnodes(vns []*Vnode, host string) []*Vnode {
+	res := make([]*Vnode, 0, len(vns))
+	for _, v := range vns {
+		if v != nil && v.Host != host {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Asks a remote vnode for our successors. Returns nil unless the first
+// successor is alive.
+func (vn *localVnode) successorsVia(remote *Vnode) []*Vnode {
+	trans := vn.ring.transport
+	_, succs, err := trans.FindSuccessors(remote, vn.ring.config.NumSuccessors, vn.Id, NewLookupMetaData())
+	if err != nil {
+		return nil
+	}
+	var res []*Vnode
+	for _, s := range succs {
+		if s != nil && !bytes.Equal(s.Id, vn.Id) && !containsVnode(res, s) {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	if alive, _ := trans.Ping(res[0]); !alive {
+		return nil
+	}
+	return res
+}
+
+// Replaces the successor list
+func (vn *localVnode) setSuccessors(succs []*Vnode) {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	for idx := range vn.successors {
+		vn.successors[idx] = nil
+		if idx < len(succs) {
+			vn.successors[idx] = succs[idx]
+		}
+	}
+}
+
+// Checks if the vnode is isolated
+func (vn *localVnode) isIsolated() bool {
+	vn.lock.RLock()
+	defer vn.lock.RUnlock()
+	return vn.isolated
+}
+
+// Tracks whether the vnode is isolated, reporting any change
+func (vn *localVnode) setIsolated(isolated bool) {
+	vn.lock.Lock()
+	changed := vn.isolated != isolated
+	vn.isolated = isolated
+	vn.lock.Unlock()
+	if !changed {
+		return
+	}
+	stats := vn.ring.config.Stats
+	if isolated {
+		if stats != nil {
+			stats.VnodeIsolated()
+		}
+		vn.ring.publish(Event{Type: EventVnodeIsolated, Vnode: &vn.Vnode})
+	} else {
+		if stats != nil {
+			stats.VnodeRecovered()
+		}
+		vn.ring.publish(Event{Type: EventVnodeRecovered, Vnode: &vn.Vnode,
+			New: vn.firstSuccessor()})
+	}
+}
@@ -0,0 +1,170 @@
+package chord
+
+import (
+	"fmt"
+	"go-chord/stats"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts the isolated and recovered vnodes
+type recoverStats struct {
+	stats.BlackholeStats
+	isolated  int32
+	recovered int32
+}
+
+func (s *recoverStats) VnodeIsolated() {
+	atomic.AddInt32(&s.isolated, 1)
+}
+
+func (s *recoverStats) VnodeRecovered() {
+	atomic.AddInt32(&s.recovered, 1)
+}
+
+func TestVnodeRecoverIsolated(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	st := &recoverStats{}
+	r.config.Stats = st
+	sub := r.Subscribe(8)
+
+	// No successor left, falls back to the local vnodes
+	vn := r.vnodes[0]
+	if err := vn.checkNewSuccessor(); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if vn.successors[0] != &r.vnodes[1].Vnode || vn.knownSuccessors() != len(r.vnodes)-1 {
+		t.Fatalf("expected local successors")
+	}
+	if !vn.isolated || !r.Isolated() || st.isolated != 1 {
+		t.Fatalf("expected isolated vnode")
+	}
+	var ev Event
+	for ev = nextEvent(t, sub); ev.Type != EventVnodeIsolated; ev = nextEvent(t, sub) {
+	}
+	if ev.Vnode != &vn.Vnode {
+		t.Fatalf("bad event %v", ev)
+	}
+
+	// Failing again is only reported once
+	vn.recoverSuccessors()
+	if st.isolated != 1 {
+		t.Fatalf("isolated reported twice")
+	}
+}
+
+func TestVnodeRecoverFinger(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	st := &recoverStats{}
+	r.config.Stats = st
+	vn := r.vnodes[0]
+
+	// A remote vnode known from the finger table
+	succ := &Vnode{Id: []byte{1}, Host: "remote"}
+	remote := &Vnode{Id: []byte{2}, Host: "remote"}
+	r.transport.Register(succ, &MockVnodeRPC{})
+	r.transport.Register(remote, &MockVnodeRPC{succ: []*Vnode{&vn.Vnode, succ}})
+	vn.finger[0] = remote
+
+	// All the known successors are dead
+	vn.successors[0] = &Vnode{Id: []byte{10}, Host: "dead"}
+	vn.successors[1] = &Vnode{Id: []byte{11}, Host: "dead"}
+	vn.isolated = true
+	if err := vn.checkNewSuccessor(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn.successors[0] != succ || vn.knownSuccessors() != 1 {
+		t.Fatalf("expected recovered successor, got %v", vn.successors)
+	}
+	if vn.isolated || st.recovered != 1 {
+		t.Fatalf("expected recovered vnode")
+	}
+}
+
+func TestRingRecoverSeeds(t *testing.T) {
+	// Two nodes sharing an in-process transport, the first with a
+	// single vnode whose successors all belong to the second
+	trans := InitLocalTransportFakeTcp(nil, nil)
+	conf1 := fastConf()
+	conf1.Hostname = "node1"
+	conf1.NumVnodes = 1
+	conf1.Seeds = []string{"node3"}
+	r1, err := Create(conf1, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf2 := fastConf()
+	conf2.Hostname = "node2"
+	r2, err := Join(conf2, trans, "node1")
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+	<-time.After(100 * time.Millisecond)
+
+	// Node 2 dies without leaving, node 1 keeps running alone
+	r2.Shutdown()
+	for _, vn := range r2.vnodes {
+		trans.(*LocalTransport).Deregister(&vn.Vnode)
+	}
+	waitFor(t, "node 1 to be isolated", r1.Isolated)
+	vns, err := r1.Lookup(1, []byte("test"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vns[0].Host != "node1" {
+		t.Fatalf("bad owner %s", vns[0].Host)
+	}
+
+	// Recovers through the seed once it is up
+	conf3 := fastConf()
+	conf3.Hostname = "node3"
+	r3, err := Create(conf3, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	waitFor(t, "node 1 to recover", func() bool { return !r1.Isolated() })
+	if r1.vnodes[0].firstSuccessor().Host != "node3" {
+		t.Fatalf("expected a successor on node 3")
+	}
+
+	r1.Shutdown()
+	r3.Shutdown()
+}
+
+// Waits until the check passes or times out
+func waitFor(t *testing.T, desc string, check func() bool) {
+	for i := 0; i < 500; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", desc)
+}
+
+func TestRememberPeers(t *testing.T) {
+	p := &peers{}
+	for i := 0; i < maxPeers; i++ {
+		p.rememberPeer(fmt.Sprintf("host%d", i))
+	}
+
+	// Seeing a host again keeps it, the least recently seen one is
+	// forgotten for a new host
+	p.rememberPeer("host0")
+	p.rememberPeer("new")
+	hosts := p.rememberedPeers()
+	if len(hosts) != maxPeers {
+		t.Fatalf("bad number of peers %d", len(hosts))
+	}
+	known := make(map[string]bool)
+	for _, h := range hosts {
+		known[h] = true
+	}
+	if !known["host0"] || !known["new"] || known["host1"] {
+		t.Fatalf("bad peers %v", hosts)
+	}
+}
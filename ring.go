@@ -12,8 +12,13 @@ func (r *Ring) init(conf *Config, trans Transport) {
 	r.vnodes = make([]*localVnode, conf.NumVnodes)
 	r.transport = InitLocalTransport(trans)
 	r.delegateCh = make(chan func(), 32)
-	if conf.UseCache {
-		r.nodeCache = make(map[string]*Vnode)
+
+	// Copy the metadata, it is shared by all the local vnodes
+	if conf.Meta != nil {
+		r.meta = make(map[string]string, len(conf.Meta))
+		for k, v := range conf.Meta {
+			r.meta[k] = v
+		}
 	}
 
 	// Initializes the vnodes
@@ -67,9 +72,21 @@ func (r *Ring) schedule() {
 
 // Wait for all the vnodes to shutdown
 func (r *Ring) stopVnodes() {
-	r.shutdown = make(chan bool, r.config.NumVnodes)
+	shutdown := make(chan bool, r.config.NumVnodes)
+
+	// Vnodes whose next stabilization is cancelled are stopped already,
+	// the others stop when their stabilization runs
+	for _, vn := range r.vnodes {
+		vn.lock.Lock()
+		vn.shutdown = shutdown
+		t := vn.timer
+		vn.lock.Unlock()
+		if t != nil && t.Stop() {
+			shutdown <- true
+		}
+	}
 	for i := 0; i < r.config.NumVnodes; i++ {
-		<-r.shutdown
+		<-shutdown
 	}
 }
 
@@ -91,6 +108,11 @@ func (r *Ring) setLocalSuccessors() {
 			vnode.successors[i] = &r.vnodes[(idx+i+1)%numV].Vnode
 		}
 	}
+
+	// A single vnode is its own successor
+	if numV == 1 {
+		r.vnodes[0].successors[0] = &r.vnodes[0].Vnode
+	}
 }
 
 // Invokes a function on the delegate and returns completion channel
@@ -0,0 +1,206 @@
+/*
+Package scheduler distributes keyed jobs over a Chord ring. Every node
+registers the same jobs, and each node only runs the jobs whose keys are
+owned by its local vnodes. Jobs are started and stopped automatically as
+ownership moves when predecessors and successors change.
+
+Ownership follows the known predecessors of the vnodes, see
+chord.Ring.OwnsKey. While a vnode does not know its predecessor yet, for
+instance right after it joins or once its predecessor failed, no node
+claims the keys it is responsible for. Their jobs do not run anywhere
+until a stabilization sets the predecessor, and jobs may run late or not
+at all while the ring is converging.
+*/
+package scheduler
+
+import (
+	"fmt"
+	"go-chord"
+	"log"
+	"sync"
+)
+
+// A Job runs for as long as the local node owns its key. It must return
+// promptly once the stop channel is closed.
+type Job interface {
+	Run(stop <-chan struct{})
+}
+
+// Adapts a function to the Job interface
+type JobFunc func(stop <-chan struct{})
+
+func (f JobFunc) Run(stop <-chan struct{}) {
+	f(stop)
+}
+
+// Number of ring events buffered. Once events are dropped, the next
+// event read triggers a full check of every job.
+const eventBuffer = 64
+
+// Scheduler runs the registered jobs owned by the local vnodes of a ring
+type Scheduler struct {
+	ring *chord.Ring
+	sub  *chord.Subscription
+	lock sync.Mutex
+	jobs map[string]*job
+	done chan struct{}
+}
+
+// A registered job and its running state
+type job struct {
+	key     []byte
+	job     Job
+	stop    chan struct{} // Non-nil while running
+	stopped chan struct{} // Closed once the last Run returns
+}
+
+// Creates a scheduler for a ring. It watches the ring events until the
+// ring or the scheduler is shut down.
+func New(ring *chord.Ring) *Scheduler {
+	return newScheduler(ring, eventBuffer)
+}
+
+// Creates a scheduler buffering the given number of ring events
+func newScheduler(ring *chord.Ring, buffer int) *Scheduler {
+	s := &Scheduler{
+		ring: ring,
+		sub:  ring.Subscribe(buffer),
+		jobs: make(map[string]*job),
+		done: make(chan struct{}),
+	}
+	go s.watch()
+	return s
+}
+
+// Registers a job with a key. The job starts right away if the key is
+// owned locally.
+func (s *Scheduler) Register(key []byte, j Job) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.jobs[string(key)]; ok {
+		return fmt.Errorf("Job already registered for key %q", key)
+	}
+	jb := &job{key: key, job: j}
+	s.jobs[string(key)] = jb
+	if s.ring.OwnsKey(key) {
+		jb.start()
+	}
+	return nil
+}
+
+// Unregisters the job for a key, stopping it if it is running
+func (s *Scheduler) Unregister(key []byte) {
+	s.lock.Lock()
+	var stopped chan struct{}
+	if jb, ok := s.jobs[string(key)]; ok {
+		stopped = jb.halt()
+	}
+	delete(s.jobs, string(key))
+	s.lock.Unlock()
+	waitStopped([]chan struct{}{stopped})
+}
+
+// Checks if the job for a key is running locally
+func (s *Scheduler) Running(key []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jb, ok := s.jobs[string(key)]
+	return ok && jb.stop != nil
+}
+
+// Stops all the jobs and stops watching the ring
+func (s *Scheduler) Shutdown() {
+	s.sub.Close()
+	<-s.done
+}
+
+// Watches the ring events, checking ownership whenever a range may
+// have moved, or events were dropped before handling the event. Stops
+// all jobs when the subscription ends.
+func (s *Scheduler) watch() {
+	defer close(s.done)
+	var dropped uint64
+	for ev := range s.sub.C {
+		if d := s.sub.Dropped(); d != dropped {
+			dropped = d
+			s.reconcile()
+		}
+		switch ev.Type {
+		case chord.EventPredecessorChanged, chord.EventSuccessorChanged:
+			s.reconcile()
+		case chord.EventVnodeLeaving:
+			s.stopAll()
+		}
+	}
+	s.stopAll()
+}
+
+// Starts and stops jobs to match the current ownership, then waits for
+// the stopped jobs to return
+func (s *Scheduler) reconcile() {
+	var stopped []chan struct{}
+	s.lock.Lock()
+	for _, jb := range s.jobs {
+		owned := s.ring.OwnsKey(jb.key)
+		if owned && jb.stop == nil {
+			jb.start()
+		} else if !owned {
+			stopped = append(stopped, jb.halt())
+		}
+	}
+	s.lock.Unlock()
+	waitStopped(stopped)
+}
+
+// Stops all the running jobs and waits for them to return
+func (s *Scheduler) stopAll() {
+	var stopped []chan struct{}
+	s.lock.Lock()
+	for _, jb := range s.jobs {
+		stopped = append(stopped, jb.halt())
+	}
+	s.lock.Unlock()
+	waitStopped(stopped)
+}
+
+// Starts running the job. A new run waits for the previous one to
+// return, so a job never runs twice at once. Must be called with the
+// lock held.
+func (jb *job) start() {
+	prev := jb.stopped
+	jb.stop = make(chan struct{})
+	jb.stopped = make(chan struct{})
+	go func(stop, stopped, prev chan struct{}) {
+		defer close(stopped)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[ERR] Caught a panic running job %q! Got: %s", jb.key, r)
+			}
+		}()
+		if prev != nil {
+			<-prev
+		}
+		jb.job.Run(stop)
+	}(jb.stop, jb.stopped, prev)
+}
+
+// Tells the job to stop if it is running. Returns a channel closed once
+// it returns, nil if it was not running. Must be called with the lock
+// held.
+func (jb *job) halt() chan struct{} {
+	if jb.stop == nil {
+		return nil
+	}
+	close(jb.stop)
+	jb.stop = nil
+	return jb.stopped
+}
+
+// Waits for the halted jobs to return
+func waitStopped(stopped []chan struct{}) {
+	for _, ch := range stopped {
+		if ch != nil {
+			<-ch
+		}
+	}
+}
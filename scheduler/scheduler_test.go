@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"fmt"
+	"go-chord"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fastConf(host string) *chord.Config {
+	conf := chord.DefaultConfig(host)
+	conf.StabilizeMin = time.Duration(15 * time.Millisecond)
+	conf.StabilizeMax = time.Duration(45 * time.Millisecond)
+	return conf
+}
+
+// Tracks which node is running each key
+type tracker struct {
+	lock    sync.Mutex
+	running map[string]string
+}
+
+func (tr *tracker) job(node, key string) Job {
+	return JobFunc(func(stop <-chan struct{}) {
+		tr.lock.Lock()
+		tr.running[key] = node
+		tr.lock.Unlock()
+		<-stop
+		tr.lock.Lock()
+		if tr.running[key] == node {
+			delete(tr.running, key)
+		}
+		tr.lock.Unlock()
+	})
+}
+
+// Waits until the check passes or times out
+func waitFor(t *testing.T, desc string, check func() bool) {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", desc)
+}
+
+func TestSchedulerSingleNode(t *testing.T) {
+	r, err := chord.Create(fastConf("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	s := New(r)
+
+	ran := make(chan struct{})
+	err = s.Register([]byte("foo"), JobFunc(func(stop <-chan struct{}) {
+		close(ran)
+		<-stop
+	}))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := s.Register([]byte("foo"), JobFunc(func(<-chan struct{}) {})); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Starts once the ring has stabilized
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatalf("job did not run")
+	}
+	if !s.Running([]byte("foo")) {
+		t.Fatalf("job should be running")
+	}
+
+	s.Unregister([]byte("foo"))
+	if s.Running([]byte("foo")) {
+		t.Fatalf("job should be stopped")
+	}
+
+	s.Shutdown()
+	r.Shutdown()
+}
+
+func TestSchedulerDroppedEvents(t *testing.T) {
+	r, err := chord.Create(fastConf("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Most events are dropped while the ring stabilizes, the jobs still
+	// start once it owns their keys
+	s := newScheduler(r, 1)
+	tr := &tracker{running: make(map[string]string)}
+	var keys []string
+	for i := 0; i < 16; i++ {
+		k := fmt.Sprintf("job-%d", i)
+		keys = append(keys, k)
+		s.Register([]byte(k), tr.job("test", k))
+	}
+	waitFor(t, "all jobs to run", func() bool {
+		tr.lock.Lock()
+		defer tr.lock.Unlock()
+		return len(tr.running) == len(keys)
+	})
+
+	s.Shutdown()
+	r.Shutdown()
+	if len(tr.running) != 0 {
+		t.Fatalf("jobs left running %v", tr.running)
+	}
+}
+
+func TestSchedulerOwnershipMoves(t *testing.T) {
+	// All the nodes share one in-process transport
+	trans := chord.InitLocalTransportFakeTcp(nil, nil)
+	tr := &tracker{running: make(map[string]string)}
+	var keys []string
+	for i := 0; i < 32; i++ {
+		keys = append(keys, fmt.Sprintf("job-%d", i))
+	}
+
+	// Start with a single node running everything
+	r1, err := chord.Create(fastConf("node1"), trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	s1 := New(r1)
+	for _, k := range keys {
+		s1.Register([]byte(k), tr.job("node1", k))
+	}
+	allOn := func(node string) func() bool {
+		return func() bool {
+			tr.lock.Lock()
+			defer tr.lock.Unlock()
+			for _, k := range keys {
+				if tr.running[k] != node {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	waitFor(t, "node1 to run all jobs", allOn("node1"))
+
+	// A second node takes over the keys it owns
+	r2, err := chord.Join(fastConf("node2"), trans, "node1")
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+	s2 := New(r2)
+	for _, k := range keys {
+		s2.Register([]byte(k), tr.job("node2", k))
+	}
+	// Every job runs on the node that owns it
+	waitFor(t, "jobs to run on their owners", func() bool {
+		owners := make(map[string]bool)
+		for _, k := range keys {
+			vns, err := r1.Lookup(1, []byte(k))
+			if err != nil {
+				return false
+			}
+			tr.lock.Lock()
+			node := tr.running[k]
+			tr.lock.Unlock()
+			if node != vns[0].Host {
+				return false
+			}
+			if s1.Running([]byte(k)) == s2.Running([]byte(k)) {
+				return false
+			}
+			owners[node] = true
+		}
+		return len(owners) == 2
+	})
+
+	// Once the second node leaves, its jobs move back
+	s2.Shutdown()
+	if err := r2.Leave(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vns, _ := trans.ListVnodes("node2")
+	for _, vn := range vns {
+		if vn.Host == "node2" {
+			trans.(*chord.LocalTransport).Deregister(vn)
+		}
+	}
+	waitFor(t, "node1 to run all jobs again", allOn("node1"))
+
+	s1.Shutdown()
+	r1.Shutdown()
+}
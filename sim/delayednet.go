@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -55,6 +56,7 @@ This is for simulation only!
 type DelayedTCPTransport struct {
 	*chord.TCPTransport
 	config     *chord.DelayTCPConfig
+	randLock   sync.Mutex
 	randSource *rand.Rand
 }
 
@@ -67,7 +69,7 @@ func InitDelayedTCPTransport(listen string, timeout time.Duration, config *chord
 	return &DelayedTCPTransport{
 		TCPTransport: tcpTransport,
 		config:       config,
-		randSource:   rand.New(rand.NewSource(time.Now().Unix())),
+		randSource:   rand.New(rand.NewSource(config.Seed)),
 	}, nil
 }
 
@@ -78,7 +80,9 @@ func (t *DelayedTCPTransport) FindSuccessors(vn *chord.Vnode, n int, k []byte, m
 	if len(t.config.RandomDelays) > 0 {
 
 		// pick a random number in the range [0,1)
+		t.randLock.Lock()
 		r := t.randSource.Float64()
+		t.randLock.Unlock()
 
 		// find the maximum probability that is smaller than rand, use the delay that corresponds to that probability
 		j := -1
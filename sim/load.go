@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"go-chord"
+	"hash"
+)
+
+// How evenly a ring spreads the hash space and the sample keys
+type LoadResult struct {
+	SampleKeys int              `json:"sampleKeys"`
+	Hosts      []chord.HostLoad `json:"hosts"`
+	HostSpace  chord.Imbalance  `json:"hostSpace"`
+	HostKeys   chord.Imbalance  `json:"hostKeys"`
+	VnodeSpace chord.Imbalance  `json:"vnodeSpace"`
+	VnodeKeys  chord.Imbalance  `json:"vnodeKeys"`
+}
+
+// Analyzes the load of the vnodes of a ring with -loadkeys sample keys,
+// and prints it per host
+func reportLoad(vnodes []*chord.Vnode, hashFunc func() hash.Hash) *LoadResult {
+	keys := make([][]byte, *loadKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%v", i))
+	}
+	report := chord.AnalyzeLoad(vnodes, hashFunc, keys)
+
+	fmt.Printf("\nLoad of %v vnodes with %v sample keys:\n", len(report.Vnodes), len(keys))
+	fmt.Printf("%-24s %6s %8s %8s\n", "Host", "Vnodes", "Space%", "Keys%")
+	for _, hl := range report.Hosts {
+		keyShare := 0.0
+		if len(keys) > 0 {
+			keyShare = float64(hl.Keys) / float64(len(keys))
+		}
+		fmt.Printf("%-24s %6v %8.3f %8.3f\n", hl.Host, hl.Vnodes, hl.Space*100, keyShare*100)
+	}
+	printImbalance("Host space", report.HostSpace)
+	printImbalance("Host keys", report.HostKeys)
+	printImbalance("Vnode space", report.VnodeSpace)
+	printImbalance("Vnode keys", report.VnodeKeys)
+
+	return &LoadResult{
+		SampleKeys: len(keys),
+		Hosts:      report.Hosts,
+		HostSpace:  report.HostSpace,
+		HostKeys:   report.HostKeys,
+		VnodeSpace: report.VnodeSpace,
+		VnodeKeys:  report.VnodeKeys,
+	}
+}
+
+func printImbalance(name string, im chord.Imbalance) {
+	fmt.Printf("%s: min %.4g, max %.4g, mean %.4g, stddev %.4g, max/mean %.3f\n",
+		name, im.Min, im.Max, im.Mean, im.StdDev, im.MaxOverMean)
+}
+
+// Returns the vnodes known by the transports of the given hosts, once each
+func collectVnodes(trans []chord.Transport, hosts []string) []*chord.Vnode {
+	seen := make(map[string]bool)
+	var vnodes []*chord.Vnode
+	for i, host := range hosts {
+		vns, err := trans[i].ListVnodes(host)
+		if err != nil {
+			fmt.Printf("Error listing the vnodes of %s: %v\n", host, err)
+			continue
+		}
+		for _, vn := range vns {
+			if !seen[vn.String()] {
+				seen[vn.String()] = true
+				vnodes = append(vnodes, vn)
+			}
+		}
+	}
+	return vnodes
+}
+
+// Returns the first n nodes of a realtime run, named and addressed the
+// same way
+func ringMembers(n int) []chord.RingMember {
+	members := make([]chord.RingMember, n)
+	for i := range members {
+		members[i] = chord.RingMember{
+			Host:     fmt.Sprintf("localhost:%v", FirstTcpPort+i),
+			NodeName: fmt.Sprintf("node-%v", i),
+		}
+	}
+	return members
+}
+
+// Computes the ring of -numnodes hosts with -vnodes each without running
+// it, and reports its load and the hash space moving with -addnodes
+func runOffline() (*Result, error) {
+	res := &Result{
+		Config: RunConfig{
+			Mode:       "offline",
+			Nodes:      *numNodes,
+			Vnodes:     *numVnodes,
+			Successors: *successors,
+		},
+	}
+	conf := chord.DefaultConfig("")
+	conf.NumVnodes = *numVnodes
+	conf.NumSuccessors = *successors
+	ring, err := chord.ComputeRing(conf, ringMembers(*numNodes))
+	if err != nil {
+		return res, err
+	}
+	res.Load = reportLoad(ring.Vnodes, conf.HashFunc)
+	if *addNodes == 0 {
+		return res, nil
+	}
+
+	other, err := chord.ComputeRing(conf, ringMembers(*numNodes+*addNodes))
+	if err != nil {
+		return res, err
+	}
+	moves := chord.DiffRings(ring, other)
+	for _, m := range moves {
+		res.MovedSpace += m.Space
+	}
+	fmt.Printf("\nChanging to %v hosts moves %v ranges, %.3f%% of the hash space\n",
+		*numNodes+*addNodes, len(moves), res.MovedSpace*100)
+	return res, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-chord"
+	"go-chord/stats"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings of a simulation run
+type RunConfig struct {
+	Mode       string `json:"mode"`     // "virtual", "faketcp" or "tcp"
+	Scenario   string `json:"scenario"` // Name of the scenario with the virtual mode
+	Nodes      int    `json:"nodes"`
+	Vnodes     int    `json:"vnodes"`
+	Successors int    `json:"successors"`
+	UseCache   bool   `json:"useCache"`
+	TcpDelay   int    `json:"tcpDelay"`   // In milliseconds, not with the virtual mode
+	RandDelays string `json:"randDelays"` // Random delay config, not with the virtual mode
+	Seed       int64  `json:"seed"`
+}
+
+// Outcome of a simulation run, written as JSON or CSV
+type Result struct {
+	Run          int               `json:"run"`    // Index of the run in a sweep
+	Params       string            `json:"params"` // Flags set by the sweep
+	Config       RunConfig         `json:"config"`
+	Scenario     *Scenario         `json:"scenario,omitempty"` // Full scenario with the virtual mode
+	Stats        stats.Summary     `json:"stats"`
+	Failures     int               `json:"failures"`     // Lookups returning an error
+	Violations   int               `json:"violations"`   // Ring invariants broken at the end except the fingers, virtual mode only
+	StaleFingers int               `json:"staleFingers"` // Fingers not pointing to their owner yet at the end, virtual mode only
+	Churn        *churnStats       `json:"churn,omitempty"`
+	Faults       *chord.FaultStats `json:"faults,omitempty"`
+	Workload     *WorkloadResult   `json:"workload,omitempty"` // Throughput workload, not with the virtual mode
+	Load         *LoadResult       `json:"load,omitempty"`     // Load spread at the end of the run
+	MovedSpace   float64           `json:"movedSpace"`         // Hash space moving with -addnodes, offline mode only
+	Error        string            `json:"error"`              // Why the run stopped early, empty on success
+}
+
+// A CSV column and how to format it
+type csvColumn struct {
+	name  string
+	value func(r *Result) string
+}
+
+func formatInt(n int) string {
+	return strconv.Itoa(n)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', 6, 64)
+}
+
+// Formats the jump counts as "jumps:lookups" pairs
+func formatJumpCounts(counts []int) string {
+	var pairs []string
+	for jumps, n := range counts {
+		if n > 0 {
+			pairs = append(pairs, fmt.Sprintf("%d:%d", jumps, n))
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Returns the churn stats, zero if there was no churn
+func (r *Result) churn() churnStats {
+	if r.Churn == nil {
+		return churnStats{}
+	}
+	return *r.Churn
+}
+
+// Returns the workload results, zero if there was no workload
+func (r *Result) workload() WorkloadResult {
+	if r.Workload == nil {
+		return WorkloadResult{}
+	}
+	return *r.Workload
+}
+
+// Returns the load results, zero if there was no load report
+func (r *Result) load() LoadResult {
+	if r.Load == nil {
+		return LoadResult{}
+	}
+	return *r.Load
+}
+
+// Columns of the CSV table, one row per run
+var csvColumns = []csvColumn{
+	{"run", func(r *Result) string { return formatInt(r.Run) }},
+	{"params", func(r *Result) string { return r.Params }},
+	{"mode", func(r *Result) string { return r.Config.Mode }},
+	{"scenario", func(r *Result) string { return r.Config.Scenario }},
+	{"nodes", func(r *Result) string { return formatInt(r.Config.Nodes) }},
+	{"vnodes", func(r *Result) string { return formatInt(r.Config.Vnodes) }},
+	{"successors", func(r *Result) string { return formatInt(r.Config.Successors) }},
+	{"use_cache", func(r *Result) string { return strconv.FormatBool(r.Config.UseCache) }},
+	{"tcp_delay_ms", func(r *Result) string { return formatInt(r.Config.TcpDelay) }},
+	{"rand_delays", func(r *Result) string { return r.Config.RandDelays }},
+	{"seed", func(r *Result) string { return strconv.FormatInt(r.Config.Seed, 10) }},
+	{"lookups", func(r *Result) string { return formatInt(r.Stats.Lookups) }},
+	{"failures", func(r *Result) string { return formatInt(r.Failures) }},
+	{"cache_hits", func(r *Result) string { return formatInt(r.Stats.CacheHits) }},
+	{"cache_rejections", func(r *Result) string { return formatInt(r.Stats.CacheRejections) }},
+	{"cache_hit_rate", func(r *Result) string { return formatFloat(r.Stats.CacheHitRate) }},
+	{"jumps_min", func(r *Result) string { return formatFloat(r.Stats.Jumps.Min) }},
+	{"jumps_avg", func(r *Result) string { return formatFloat(r.Stats.Jumps.Avg) }},
+	{"jumps_p50", func(r *Result) string { return formatFloat(r.Stats.Jumps.P50) }},
+	{"jumps_p90", func(r *Result) string { return formatFloat(r.Stats.Jumps.P90) }},
+	{"jumps_p99", func(r *Result) string { return formatFloat(r.Stats.Jumps.P99) }},
+	{"jumps_max", func(r *Result) string { return formatFloat(r.Stats.Jumps.Max) }},
+	{"jump_counts", func(r *Result) string { return formatJumpCounts(r.Stats.JumpCounts) }},
+	{"lookup_ms_min", func(r *Result) string { return formatFloat(r.Stats.LookupTimeMs.Min) }},
+	{"lookup_ms_avg", func(r *Result) string { return formatFloat(r.Stats.LookupTimeMs.Avg) }},
+	{"lookup_ms_p50", func(r *Result) string { return formatFloat(r.Stats.LookupTimeMs.P50) }},
+	{"lookup_ms_p90", func(r *Result) string { return formatFloat(r.Stats.LookupTimeMs.P90) }},
+	{"lookup_ms_p99", func(r *Result) string { return formatFloat(r.Stats.LookupTimeMs.P99) }},
+	{"lookup_ms_max", func(r *Result) string { return formatFloat(r.Stats.LookupTimeMs.Max) }},
+	{"isolated_vnodes", func(r *Result) string { return formatInt(r.Stats.IsolatedVnodes) }},
+	{"recovered_vnodes", func(r *Result) string { return formatInt(r.Stats.RecoveredVnodes) }},
+	{"violations", func(r *Result) string { return formatInt(r.Violations) }},
+	{"stale_fingers", func(r *Result) string { return formatInt(r.StaleFingers) }},
+	{"churn_joins", func(r *Result) string { return formatInt(r.churn().Joins) }},
+	{"churn_leaves", func(r *Result) string { return formatInt(r.churn().Leaves) }},
+	{"churn_crashes", func(r *Result) string { return formatInt(r.churn().Crashes) }},
+	{"churn_lookups", func(r *Result) string { return formatInt(r.churn().Lookups) }},
+	{"churn_failed", func(r *Result) string { return formatInt(r.churn().Failed) }},
+	{"churn_wrong_owner", func(r *Result) string { return formatInt(r.churn().WrongOwner) }},
+	{"converged", func(r *Result) string { return strconv.FormatBool(r.churn().Converged) }},
+	{"convergence", func(r *Result) string { return r.churn().Convergence.String() }},
+	{"workload_keys", func(r *Result) string { return r.workload().Keys }},
+	{"workload_clients", func(r *Result) string { return formatInt(r.workload().Clients) }},
+	{"workload_target_rate", func(r *Result) string { return formatFloat(r.workload().TargetRate) }},
+	{"workload_lookups", func(r *Result) string { return formatInt(r.workload().Lookups) }},
+	{"workload_errors", func(r *Result) string { return formatInt(r.workload().Errors) }},
+	{"workload_throughput", func(r *Result) string { return formatFloat(r.workload().Throughput) }},
+	{"workload_ms_avg", func(r *Result) string { return formatFloat(r.workload().LatencyMs.Avg) }},
+	{"workload_ms_p50", func(r *Result) string { return formatFloat(r.workload().LatencyMs.P50) }},
+	{"workload_ms_p90", func(r *Result) string { return formatFloat(r.workload().LatencyMs.P90) }},
+	{"workload_ms_p99", func(r *Result) string { return formatFloat(r.workload().LatencyMs.P99) }},
+	{"workload_ms_max", func(r *Result) string { return formatFloat(r.workload().LatencyMs.Max) }},
+	{"load_sample_keys", func(r *Result) string { return formatInt(r.load().SampleKeys) }},
+	{"load_host_space_stddev", func(r *Result) string { return formatFloat(r.load().HostSpace.StdDev) }},
+	{"load_host_space_max_over_mean", func(r *Result) string { return formatFloat(r.load().HostSpace.MaxOverMean) }},
+	{"load_host_keys_stddev", func(r *Result) string { return formatFloat(r.load().HostKeys.StdDev) }},
+	{"load_host_keys_max_over_mean", func(r *Result) string { return formatFloat(r.load().HostKeys.MaxOverMean) }},
+	{"load_vnode_space_max_over_mean", func(r *Result) string { return formatFloat(r.load().VnodeSpace.MaxOverMean) }},
+	{"load_vnode_keys_max_over_mean", func(r *Result) string { return formatFloat(r.load().VnodeKeys.MaxOverMean) }},
+	{"moved_space", func(r *Result) string { return formatFloat(r.MovedSpace) }},
+	{"error", func(r *Result) string { return r.Error }},
+}
+
+// Writes the results as a JSON array
+func writeJSON(path string, results []*Result) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Writes the results as a CSV table with a header row
+func writeCSV(path string, results []*Result) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	row := make([]string, len(csvColumns))
+	for i, c := range csvColumns {
+		row[i] = c.name
+	}
+	w.Write(row)
+	for _, r := range results {
+		for i, c := range csvColumns {
+			row[i] = c.value(r)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-chord"
+	"io/ioutil"
+	"time"
+)
+
+// A time.Duration written as a string such as "1m30s" in scenario files
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Duration must be a string like \"1m30s\"! Got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Describes a simulation on a virtual clock: the ring to build, the
+// faults to inject, the churn and the workload. Scenarios are loaded from
+// JSON files, or built from the command line flags.
+type Scenario struct {
+	Name          string           `json:"name"`
+	Nodes         int              `json:"nodes"`         // Number of nodes
+	Vnodes        int              `json:"vnodes"`        // Number of vnodes per node
+	Successors    int              `json:"successors"`    // Number of successors per vnode
+	Seed          int64            `json:"seed"`          // Seed of every random choice
+	StabilizeMin  Duration         `json:"stabilizeMin"`  // Minimum stabilization interval
+	StabilizeMax  Duration         `json:"stabilizeMax"`  // Maximum stabilization interval
+	MergeInterval Duration         `json:"mergeInterval"` // How often to look for other rings, 0 to disable
+	JoinInterval  Duration         `json:"joinInterval"`  // Simulated time between the initial joins
+	Settle        Duration         `json:"settle"`        // Simulated time for the ring to settle
+	Faults        []ScenarioFault  `json:"faults"`        // Injected while the ring settles and churns
+	Churn         ScenarioChurn    `json:"churn"`         // Random churn after settling
+	Events        []ScenarioEvent  `json:"events"`        // Churn events at specific times
+	Workload      ScenarioWorkload `json:"workload"`      // Lookups made during and after churn
+}
+
+// Faults injected into the RPCs of a link
+type ScenarioFault struct {
+	From          string           `json:"from"` // Empty for any host
+	To            string           `json:"to"`   // Empty for any host
+	RPCs          []string         `json:"rpcs"` // RPC names such as "FindSuccessors", empty for all
+	Latency       *ScenarioLatency `json:"latency"`
+	DropRate      float64          `json:"dropRate"`
+	DropTimeout   Duration         `json:"dropTimeout"`
+	ErrorRate     float64          `json:"errorRate"`
+	DuplicateRate float64          `json:"duplicateRate"`
+	ReorderRate   float64          `json:"reorderRate"`
+	ReorderDelay  Duration         `json:"reorderDelay"`
+}
+
+// A latency distribution: "fixed" uses Mean, "uniform" uses Min and Max,
+// "exponential" uses Mean
+type ScenarioLatency struct {
+	Distribution string   `json:"distribution"`
+	Min          Duration `json:"min"`
+	Max          Duration `json:"max"`
+	Mean         Duration `json:"mean"`
+}
+
+// Random churn, at rates per simulated minute
+type ScenarioChurn struct {
+	Duration  Duration `json:"duration"` // 0 for no random churn
+	JoinRate  float64  `json:"joinRate"`
+	LeaveRate float64  `json:"leaveRate"`
+	CrashRate float64  `json:"crashRate"`
+}
+
+// An event at a time after the ring settled. Actions are "join", "leave"
+// and "crash" of Count random nodes, "partition" into Groups of node names,
+// and "heal".
+type ScenarioEvent struct {
+	At     Duration   `json:"at"`
+	Action string     `json:"action"`
+	Count  int        `json:"count"`
+	Groups [][]string `json:"groups"`
+}
+
+// Lookups made during and after the churn
+type ScenarioWorkload struct {
+	LookupRate float64 `json:"lookupRate"` // Lookups per simulated second during churn
+	Lookups    int     `json:"lookups"`    // Lookups checked for consistency at the end
+}
+
+// Returns the default scenario, the one of the default flags
+func DefaultScenario() *Scenario {
+	return &Scenario{
+		Name:         "default",
+		Nodes:        DefaultNodeCount,
+		Vnodes:       2,
+		Successors:   1,
+		Seed:         1,
+		StabilizeMin: Duration(15 * time.Second),
+		StabilizeMax: Duration(45 * time.Second),
+		JoinInterval: Duration(time.Second),
+		Settle:       Duration(6 * time.Hour),
+		Workload:     ScenarioWorkload{LookupRate: 10, Lookups: 50},
+	}
+}
+
+// Loads a scenario from a JSON file. Missing settings keep their default.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := DefaultScenario()
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("Failed to parse scenario %s! Got %s", path, err)
+	}
+	if err := sc.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid scenario %s! Got %s", path, err)
+	}
+	return sc, nil
+}
+
+// Checks the scenario settings
+func (sc *Scenario) validate() error {
+	if sc.Nodes < 1 || sc.Vnodes < 1 || sc.Successors < 1 {
+		return fmt.Errorf("Need at least one node, vnode and successor")
+	}
+	if sc.StabilizeMin <= 0 || sc.StabilizeMax < sc.StabilizeMin {
+		return fmt.Errorf("Bad stabilization interval %v-%v",
+			time.Duration(sc.StabilizeMin), time.Duration(sc.StabilizeMax))
+	}
+	for _, f := range sc.Faults {
+		if _, _, err := f.fault(); err != nil {
+			return err
+		}
+	}
+	for _, ev := range sc.Events {
+		switch ev.Action {
+		case "join", "leave", "crash", "partition", "heal":
+		default:
+			return fmt.Errorf("Unknown event action %q", ev.Action)
+		}
+	}
+	return nil
+}
+
+// Returns the simulated time of churn, until the last event
+func (sc *Scenario) churnDuration() time.Duration {
+	d := time.Duration(sc.Churn.Duration)
+	for _, ev := range sc.Events {
+		if at := time.Duration(ev.At); at > d {
+			d = at
+		}
+	}
+	return d
+}
+
+// Converts to a fault and the RPC types it applies to
+func (f *ScenarioFault) fault() (*chord.Fault, []chord.RPCType, error) {
+	var rpcs []chord.RPCType
+	for _, name := range f.RPCs {
+		rpc, err := parseRPCType(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		rpcs = append(rpcs, rpc)
+	}
+	fault := &chord.Fault{
+		DropRate:      f.DropRate,
+		DropTimeout:   time.Duration(f.DropTimeout),
+		ErrorRate:     f.ErrorRate,
+		DuplicateRate: f.DuplicateRate,
+		ReorderRate:   f.ReorderRate,
+		ReorderDelay:  time.Duration(f.ReorderDelay),
+	}
+	if f.Latency != nil {
+		latency, err := f.Latency.latency()
+		if err != nil {
+			return nil, nil, err
+		}
+		fault.Latency = latency
+	}
+	return fault, rpcs, nil
+}
+
+// Converts the distribution to a latency
+func (l *ScenarioLatency) latency() (chord.Latency, error) {
+	switch l.Distribution {
+	case "fixed":
+		return chord.FixedLatency(time.Duration(l.Mean)), nil
+	case "uniform":
+		return chord.UniformLatency(time.Duration(l.Min), time.Duration(l.Max)), nil
+	case "exponential":
+		return chord.ExponentialLatency(time.Duration(l.Mean)), nil
+	default:
+		return nil, fmt.Errorf("Unknown latency distribution %q", l.Distribution)
+	}
+}
+
+// Finds the RPC type with the given name
+func parseRPCType(name string) (chord.RPCType, error) {
+	for rpc := chord.RPCListVnodes; rpc <= chord.RPCLeaveHandover; rpc++ {
+		if rpc.String() == name {
+			return rpc, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown RPC %q", name)
+}
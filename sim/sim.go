@@ -19,48 +19,223 @@ const (
 )
 
 type nodeInfo struct {
+	Host      string
 	Ring      *chord.Ring
 	Transport chord.Transport
 }
 
+// flags
+var (
+	def             = DefaultScenario()
+	numNodes        = flag.Int("numnodes", DefaultNodeCount, "number of nodes")
+	numVnodes       = flag.Int("vnodes", def.Vnodes, "number of vnodes per node")
+	successors      = flag.Int("successors", def.Successors, "number of successors per vnode")
+	tcpDelay        = flag.Int("tcpdelay", TcpDelay, "tcp delay in milliseconds")
+	randDelayConfig = flag.String("randdelayconfig", "", "'200:.1|300:.2|500:.3' means delay 200ms 10% of the time, 300ms 20% of the time")
+	useCache        = flag.Bool("usecache", false, "use the node cache or not, realtime runs only since -virtual always runs without it")
+	fakeTcp         = flag.Bool("faketcp", false, "fake the tcp connection")
+	virtual         = flag.Bool("virtual", false, "run on a virtual clock, reproducible from the seed. Ignores the delays and -usecache, use a realtime run to compare the cache")
+	scenario        = flag.String("scenario", "", "JSON scenario file to run on a virtual clock, the -virtual flags set explicitly override it")
+	seed            = flag.Int64("seed", def.Seed, "random seed of the simulation")
+	joinInterval    = flag.Duration("joininterval", time.Duration(def.JoinInterval), "simulated time between node joins with -virtual")
+	settle          = flag.Duration("settle", time.Duration(def.Settle), "simulated time for the ring to settle with -virtual")
+	dropRate        = flag.Float64("droprate", 0, "probability of dropping an RPC while the ring settles and churns with -virtual")
+	errorRate       = flag.Float64("errorrate", 0, "probability of failing an RPC while the ring settles and churns with -virtual")
+	dupRate         = flag.Float64("duprate", 0, "probability of duplicating an RPC while the ring settles and churns with -virtual")
+	churn           = flag.Duration("churn", 0, "simulated time of churn after the ring settles with -virtual")
+	joinRate        = flag.Float64("joinrate", 0, "nodes joining per simulated minute of churn")
+	leaveRate       = flag.Float64("leaverate", 0, "nodes leaving gracefully per simulated minute of churn")
+	crashRate       = flag.Float64("crashrate", 0, "nodes crashing per simulated minute of churn")
+	lookupRate      = flag.Float64("lookuprate", def.Workload.LookupRate, "lookups per simulated second of churn")
+	clients         = flag.Int("clients", 1, "concurrent clients of the lookup workload")
+	rate            = flag.Float64("rate", 0, "target lookups per second of the workload over all the clients, 0 for as fast as possible")
+	loadTime        = flag.Duration("loadtime", 0, "how long to run the lookup workload after the consistency checks, 0 to skip it. Not with -virtual")
+	keyDist         = flag.String("keys", "uniform", "key distribution of the workload: uniform, zipf or hot")
+	keySpace        = flag.Int("keyspace", 10000, "number of distinct keys of the workload")
+	zipfS           = flag.Float64("zipfs", 1.1, "skew of the zipf key distribution, above 1")
+	hotKeys         = flag.Int("hotkeys", 10, "number of hot keys of the hot key distribution")
+	hotFraction     = flag.Float64("hotfraction", 0.9, "fraction of the lookups going to the hot keys")
+	loadReport      = flag.Bool("loadreport", false, "report how evenly the keys spread over the hosts and vnodes at the end of the run")
+	loadKeys        = flag.Int("loadkeys", 100000, "number of sample keys of the load report")
+	offline         = flag.Bool("offline", false, "only compute the ring of -numnodes hosts with -vnodes each and report its load, without running it")
+	addNodes        = flag.Int("addnodes", 0, "with -offline, also report the hash space moving when adding this many hosts, or removing them if negative")
+	jsonPath        = flag.String("json", "", "write the results of the runs to this JSON file")
+	csvPath         = flag.String("csv", "", "write the results of the runs to this CSV file, one row per run")
+	sweep           sweepFlags
+)
+
+func init() {
+	flag.Var(&sweep, "sweep", "'numnodes=2,4,8' runs once per value of the flag, repeat to run every combination of several flags")
+}
+
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	// flags
-	var numNodes = flag.Int("numnodes", DefaultNodeCount, "number of nodes")
-	var tcpDelay = flag.Int("tcpdelay", TcpDelay, "tcp delay in milliseconds")
-	var randDelayConfig = flag.String("randdelayconfig", "", "'200:.1|300:.2|500:.3' means delay 200ms 10% of the time, 300ms 20% of the time")
-	var useCache = flag.Bool("usecache", false, "use the node cache or not")
-	var fakeTcp = flag.Bool("faketcp", false, "fake the tcp connection")
 	flag.Parse()
 
-	// collect stats
+	// run each combination of the swept flags
+	combos := sweep.combinations()
+	results := make([]*Result, 0, len(combos))
+	failed := false
+	for i, combo := range combos {
+		params, err := applyFlags(combo)
+		if err != nil {
+			fmt.Printf("\nError setting up run %v: %v\n", i, err)
+			os.Exit(1)
+		}
+		if len(sweep) > 0 {
+			fmt.Printf("[RUN %v/%v] %s\n", i+1, len(combos), params)
+		}
+		res := runOnce()
+		res.Run = i
+		res.Params = params
+		if res.Error != "" {
+			fmt.Printf("\nError running simulation: %v\n", res.Error)
+			failed = true
+		}
+		results = append(results, res)
+	}
+
+	if *jsonPath != "" {
+		if err := writeJSON(*jsonPath, results); err != nil {
+			fmt.Printf("\nError writing the JSON results: %v\n", err)
+			failed = true
+		}
+	}
+	if *csvPath != "" {
+		if err := writeCSV(*csvPath, results); err != nil {
+			fmt.Printf("\nError writing the CSV results: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Runs a simulation with the current flags, and prints its stats
+func runOnce() *Result {
 	stats := stats.NewPrintStats()
-	defer stats.Print()
+	var res *Result
+	var err error
+	if *offline {
+		res, err = runOffline()
+	} else if *virtual || *scenario != "" {
+		res, err = runVirtual(stats)
+	} else {
+		res, err = runRealtime(stats)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		fmt.Println("\nSimulation finished")
+	}
+	if !*offline {
+		stats.Print()
+		fmt.Print("\n\n")
+	}
+	res.Stats = stats.Summary()
+	return res
+}
+
+// Simulates on a virtual clock the scenario file or the default scenario,
+// overridden by the flags set explicitly or by a sweep
+func runVirtual(stats *stats.PrintStats) (*Result, error) {
+	sc := DefaultScenario()
+	if *scenario != "" {
+		var err error
+		if sc, err = LoadScenario(*scenario); err != nil {
+			return &Result{Config: RunConfig{Mode: "virtual"}}, err
+		}
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["numnodes"] {
+		sc.Nodes = *numNodes
+	}
+	if set["vnodes"] {
+		sc.Vnodes = *numVnodes
+	}
+	if set["successors"] {
+		sc.Successors = *successors
+	}
+	if set["seed"] {
+		sc.Seed = *seed
+	}
+	if set["joininterval"] {
+		sc.JoinInterval = Duration(*joinInterval)
+	}
+	if set["settle"] {
+		sc.Settle = Duration(*settle)
+	}
+	if set["churn"] {
+		sc.Churn.Duration = Duration(*churn)
+	}
+	if set["joinrate"] {
+		sc.Churn.JoinRate = *joinRate
+	}
+	if set["leaverate"] {
+		sc.Churn.LeaveRate = *leaveRate
+	}
+	if set["crashrate"] {
+		sc.Churn.CrashRate = *crashRate
+	}
+	if set["lookuprate"] {
+		sc.Workload.LookupRate = *lookupRate
+	}
+	if set["droprate"] || set["errorrate"] || set["duprate"] {
+		sc.Faults = []ScenarioFault{{DropRate: *dropRate, ErrorRate: *errorRate, DuplicateRate: *dupRate}}
+	}
+	if err := sc.validate(); err != nil {
+		return &Result{Config: RunConfig{Mode: "virtual"}, Scenario: sc}, err
+	}
+	return RunVirtual(sc, stats)
+}
+
+// Simulates on the wall clock, over TCP or an in-process transport
+func runRealtime(stats *stats.PrintStats) (*Result, error) {
+	res := &Result{
+		Config: RunConfig{
+			Mode:       "tcp",
+			Nodes:      *numNodes,
+			Vnodes:     *numVnodes,
+			Successors: *successors,
+			UseCache:   *useCache,
+			TcpDelay:   *tcpDelay,
+			RandDelays: *randDelayConfig,
+			Seed:       *seed,
+		},
+	}
+	if *fakeTcp {
+		res.Config.Mode = "faketcp"
+	}
 
 	// delay config
 	delayConf := DefaultDelayConfig()
 	delayConf.FindSuccessorsDelay = uint64(*tcpDelay)
+	delayConf.Seed = *seed
 	if *randDelayConfig != "" {
 		randDelays, err := NewProbabilityDelaysFromStr(*randDelayConfig)
 		if err != nil {
-			fmt.Printf("\nError parsing random delay config: %v", err)
-			os.Exit(1)
+			return res, fmt.Errorf("Error parsing random delay config: %v", err)
 		}
 		delayConf.RandomDelays = randDelays
 	}
 
 	// get a ring up and running!
 	fmt.Print("Starting ring ")
-	nodeMap := make(map[string]nodeInfo)
+	var nodes []nodeInfo
+	defer func() { shutdownNodes(nodes) }()
 	port := FirstTcpPort
 	tcpTimeout := time.Second * 30
 
 	// Initialize a transport that knows all nodes
 	localTransport := chord.InitLocalTransportFakeTcp(nil, delayConf)
 	for i := 0; i < *numNodes; i++ {
-		conf := chord.DefaultConfig(fmt.Sprintf(":%v", port))
+		// listen on all interfaces, advertise the loopback address
+		conf := chord.DefaultConfig(fmt.Sprintf("localhost:%v", port))
+		conf.NodeName = fmt.Sprintf("node-%v", i)
+		conf.BindAddr = fmt.Sprintf(":%v", port)
 
 		// we don't need to stabilize that often, since we are not joining/leaving nodes yet
 		if *fakeTcp {
@@ -70,12 +245,10 @@ func main() {
 			conf.StabilizeMin = 1 * time.Second
 			conf.StabilizeMax = 3 * time.Second
 		}
-		conf.NumSuccessors = 1
+		conf.NumSuccessors = *successors
 		conf.Stats = stats
 		conf.UseCache = *useCache
-
-		// 2 virtual nodes per physical node
-		conf.NumVnodes = 2
+		conf.NumVnodes = *numVnodes
 		var r *chord.Ring
 		var err error
 
@@ -84,10 +257,9 @@ func main() {
 		if *fakeTcp {
 			transport = chord.InitLocalTransport(localTransport)
 		} else {
-			transport, err = InitDelayedTCPTransport(fmt.Sprintf(":%v", port), tcpTimeout, delayConf)
+			transport, err = InitDelayedTCPTransport(conf.ListenAddr(), tcpTimeout, delayConf)
 			if err != nil {
-				fmt.Printf("Error creating chord ring: %v", err)
-				os.Exit(1)
+				return res, fmt.Errorf("Error creating chord ring: %v", err)
 			}
 		}
 		if i == 0 {
@@ -95,22 +267,21 @@ func main() {
 			// create first host
 			r, err = chord.Create(conf, transport)
 			if err != nil {
-				fmt.Printf("Error creating chord ring: %v", err)
-				os.Exit(1)
+				return res, fmt.Errorf("Error creating chord ring: %v", err)
 			}
 		} else {
 
 			// join the first host
-			r, err = chord.Join(conf, transport, fmt.Sprintf(":%v", FirstTcpPort))
+			r, err = chord.Join(conf, transport, fmt.Sprintf("localhost:%v", FirstTcpPort))
 			if err != nil {
-				fmt.Printf("Error joining chord ring: %v", err)
-				os.Exit(1)
+				return res, fmt.Errorf("Error joining chord ring: %v", err)
 			}
 		}
-		nodeMap[conf.Hostname] = nodeInfo{
+		nodes = append(nodes, nodeInfo{
+			Host:      conf.Hostname,
 			Ring:      r,
 			Transport: transport,
-		}
+		})
 		if !*fakeTcp {
 			time.Sleep(5 * time.Second)
 		} else {
@@ -129,53 +300,96 @@ func main() {
 	}
 	fmt.Printf("\nBeginning Simulation w/ general TCP delay of %vms, and TCP random delay of %v, and caching:%v\n",
 		delayConf.FindSuccessorsDelay, *randDelayConfig, *useCache)
-	if err := RandomKeyLookups(nodeMap, 50); err != nil {
-		fmt.Printf("\nError running simulation: %v\n", err)
-		os.Exit(1)
+	failures, err := RandomKeyLookups(nodes, 50, *seed)
+	res.Failures = failures
+	if err != nil {
+		return res, err
+	}
+	if *loadReport {
+		trans := make([]chord.Transport, len(nodes))
+		hosts := make([]string, len(nodes))
+		for i, n := range nodes {
+			trans[i] = n.Transport
+			hosts[i] = n.Host
+		}
+		res.Load = reportLoad(collectVnodes(trans, hosts), chord.DefaultConfig("").HashFunc)
+	}
+	if *loadTime <= 0 {
+		return res, nil
+	}
+
+	w := &Workload{
+		Clients:     *clients,
+		Rate:        *rate,
+		Duration:    *loadTime,
+		Keys:        *keyDist,
+		KeySpace:    *keySpace,
+		ZipfS:       *zipfS,
+		HotKeys:     *hotKeys,
+		HotFraction: *hotFraction,
+		Seed:        *seed,
+	}
+	rings := make([]*chord.Ring, len(nodes))
+	for i, n := range nodes {
+		rings[i] = n.Ring
+	}
+	fmt.Printf("Running %v %v key lookup clients for %v\n", w.Clients, w.Keys, w.Duration)
+	if res.Workload, err = RunWorkload(w, rings); err != nil {
+		return res, err
+	}
+	wr := res.Workload
+	fmt.Printf("Lookups: %v, errors: %v, throughput: %.1f/s\n", wr.Lookups, wr.Errors, wr.Throughput)
+	fmt.Printf("Latency (milliseconds): p50 %.3f, p90 %.3f, p99 %.3f, max %.3f\n",
+		wr.LatencyMs.P50, wr.LatencyMs.P90, wr.LatencyMs.P99, wr.LatencyMs.Max)
+	return res, nil
+}
+
+// Stops the nodes and closes their TCP listeners, so the next run can
+// reuse the ports
+func shutdownNodes(nodes []nodeInfo) {
+	for _, n := range nodes {
+		n.Ring.Shutdown()
+		if t, ok := n.Transport.(*DelayedTCPTransport); ok {
+			t.Shutdown()
+		}
 	}
-	fmt.Println("\nSimulation finished")
 }
 
-// Performs lookupCount random key lookups
-func RandomKeyLookups(nodes map[string]nodeInfo, lookupCount int) error {
-	fmt.Println("\n")
-	r := rand.New(rand.NewSource(time.Now().Unix()))
+// Performs lookupCount random key lookups drawn from seed, returns the number of failed ones
+func RandomKeyLookups(nodes []nodeInfo, lookupCount int, seed int64) (int, error) {
+	fmt.Print("\n\n")
+	r := rand.New(rand.NewSource(seed))
+	failures := 0
 	for i := 0; i < lookupCount; i++ {
 
 		// generate random lookup value
-		val := []byte(string(r.Int63n(int64(lookupCount))))
+		val := []byte(string(rune(r.Int63n(int64(lookupCount)))))
 
 		// pick 10 random nodes and ask each node to perform the lookup, and ensure the result is the same!
 		result := ""
 		for k := 0; k < 10; k++ {
 
 			// Pick a random node
-			randNode := r.Int63n(int64(len(nodes)))
-			var j int64 = 0
-			for _, n := range nodes {
-				if j == randNode {
-					resultNodes, err := n.Ring.Lookup(1, val)
-					if err != nil {
-						fmt.Printf("\nError during lookup %v: %v", i, err)
-						continue
-					}
-					if len(resultNodes) != 1 {
-						fmt.Printf("\nExpected exactly 1 node to contain the value")
-						continue
-					}
-					if result == "" {
-						result = resultNodes[0].Host
-					} else if result != resultNodes[0].Host {
-						return errors.New("Inconsistent node hashing!")
-					}
-					time.Sleep(10 * time.Millisecond)
-					break
-				}
-				j++
+			n := nodes[r.Intn(len(nodes))]
+			resultNodes, err := n.Ring.Lookup(1, val)
+			if err != nil {
+				fmt.Printf("\nError during lookup %v: %v", i, err)
+				failures++
+				continue
+			}
+			if len(resultNodes) != 1 {
+				fmt.Printf("\nExpected exactly 1 node to contain the value")
+				continue
+			}
+			if result == "" {
+				result = resultNodes[0].Host
+			} else if result != resultNodes[0].Host {
+				return failures, errors.New("Inconsistent node hashing!")
 			}
+			time.Sleep(10 * time.Millisecond)
 		}
 		fmt.Print(".")
 	}
-	fmt.Println("\n")
-	return nil
+	fmt.Print("\n\n")
+	return failures, nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// A flag and the values a sweep gives it
+type sweepParam struct {
+	name   string
+	values []string
+}
+
+// The -sweep flags, each sweeping one flag over a list of values. The
+// sweep runs every combination of the values.
+type sweepFlags []sweepParam
+
+func (s *sweepFlags) String() string {
+	var parts []string
+	for _, p := range *s {
+		parts = append(parts, p.name+"="+strings.Join(p.values, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Parses "name=v1,v2,..." for a flag defined by the simulator
+func (s *sweepFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return fmt.Errorf("Sweep must look like flag=value1,value2! Got %q", value)
+	}
+	name := strings.TrimPrefix(kv[0], "-")
+	switch name {
+	case "sweep", "json", "csv":
+		return fmt.Errorf("Cannot sweep -%s!", name)
+	}
+	if flag.Lookup(name) == nil {
+		return fmt.Errorf("Unknown flag to sweep -%s!", name)
+	}
+	*s = append(*s, sweepParam{name: name, values: strings.Split(kv[1], ",")})
+	return nil
+}
+
+// A value given to a flag in one run of a sweep
+type flagValue struct {
+	name  string
+	value string
+}
+
+// Returns every combination of the swept values, the first flag varying
+// slowest. Without any sweep, returns a single empty combination.
+func (s sweepFlags) combinations() [][]flagValue {
+	runs := [][]flagValue{nil}
+	for _, p := range s {
+		var next [][]flagValue
+		for _, run := range runs {
+			for _, v := range p.values {
+				combo := append(append([]flagValue(nil), run...), flagValue{p.name, v})
+				next = append(next, combo)
+			}
+		}
+		runs = next
+	}
+	return runs
+}
+
+// Sets the flags of a combination, and describes it as "name=value ..."
+func applyFlags(combo []flagValue) (string, error) {
+	var parts []string
+	for _, fv := range combo {
+		if err := flag.Set(fv.name, fv.value); err != nil {
+			return "", fmt.Errorf("Bad value for -%s: %v", fv.name, err)
+		}
+		parts = append(parts, fv.name+"="+fv.value)
+	}
+	return strings.Join(parts, " "), nil
+}
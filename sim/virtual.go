@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-chord"
+	"go-chord/stats"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Simulates nodes on a virtual clock. All the nodes share an in-process
+// transport and stabilize from the clock, in a single goroutine, so a run
+// only depends on its seed and takes far less than the simulated time.
+type virtualSim struct {
+	clock    *chord.VirtualClock
+	rand     *rand.Rand
+	local    *chord.LocalTransport
+	faults   *chord.FaultNet
+	stats    stats.ChordStats
+	sc       *Scenario
+	nextNode int
+	nodes    []*simNode // The running nodes
+	churn    churnStats
+	depth    int       // Nesting of the call latencies in progress
+	sleepEnd time.Time // End of the call latencies in progress
+}
+
+// A running node
+type simNode struct {
+	name string
+	ring *chord.Ring
+}
+
+// Creates a simulation of a scenario
+func newVirtualSim(sc *Scenario, stats stats.ChordStats) *virtualSim {
+	s := &virtualSim{
+		clock: chord.NewVirtualClock(time.Unix(0, 0)),
+		rand:  rand.New(rand.NewSource(sc.Seed)),
+		local: chord.InitLocalTransportFakeTcp(nil, nil).(*chord.LocalTransport),
+		stats: stats,
+		sc:    sc,
+	}
+
+	s.faults = chord.NewFaultNet(s.local, sc.Seed)
+	s.faults.SetSleep(s.sleep)
+	return s
+}
+
+// Delays a call by advancing the clock, so the other timers run meanwhile
+func (s *virtualSim) sleep(d time.Duration) {
+	if end := s.clock.Now().Add(d); end.After(s.sleepEnd) {
+		s.sleepEnd = end
+	}
+	s.depth++
+	s.clock.Advance(d)
+	s.depth--
+}
+
+// Returns the configuration of a node
+func (s *virtualSim) config(name string) *chord.Config {
+	conf := chord.DefaultConfig(name)
+	conf.NumVnodes = s.sc.Vnodes
+	conf.NumSuccessors = s.sc.Successors
+	conf.StabilizeMin = time.Duration(s.sc.StabilizeMin)
+	conf.StabilizeMax = time.Duration(s.sc.StabilizeMax)
+	conf.MergeInterval = time.Duration(s.sc.MergeInterval)
+	conf.Stats = s.stats
+	conf.Clock = s.clock
+	conf.Rand = rand.New(chord.NewLockedSource(s.rand.Int63()))
+
+	// The cache lookup races the finger lookup, and the goroutine
+	// scheduler picks the winner, which is not reproducible
+	conf.UseCache = false
+	return conf
+}
+
+// Starts a new node, joining a random running node
+func (s *virtualSim) addNode() error {
+	name := fmt.Sprintf("node-%v", s.nextNode)
+	s.nextNode++
+	conf := s.config(name)
+	trans := s.faults.Transport(name)
+	var r *chord.Ring
+	var err error
+	if len(s.nodes) == 0 {
+		r, err = chord.Create(conf, trans)
+	} else {
+		existing := s.nodes[s.rand.Intn(len(s.nodes))]
+		r, err = chord.Join(conf, trans, existing.name)
+	}
+	if err != nil {
+		return err
+	}
+	s.nodes = append(s.nodes, &simNode{name: name, ring: r})
+	return nil
+}
+
+// Stops a random node, either leaving gracefully or crashing. The
+// vnodes of the node become unreachable.
+func (s *virtualSim) removeNode(graceful bool) {
+	idx := s.rand.Intn(len(s.nodes))
+	node := s.nodes[idx]
+	s.nodes = append(s.nodes[:idx], s.nodes[idx+1:]...)
+	if graceful {
+		node.ring.Leave()
+	} else {
+		node.ring.Shutdown()
+	}
+	vns, _ := s.local.ListVnodes(node.name)
+	for _, vn := range vns {
+		if vn.Host == node.name {
+			s.local.Deregister(vn)
+		}
+	}
+}
+
+// Returns a random running ring
+func (s *virtualSim) randomRing() *chord.Ring {
+	return s.nodes[s.rand.Intn(len(s.nodes))].ring
+}
+
+// Returns the rings of the running nodes
+func (s *virtualSim) rings() []*chord.Ring {
+	rings := make([]*chord.Ring, len(s.nodes))
+	for i, n := range s.nodes {
+		rings[i] = n.ring
+	}
+	return rings
+}
+
+// Returns the vnode that should own a key, given the running vnodes
+func (s *virtualSim) idealOwner(key []byte) *chord.Vnode {
+	h := s.config("").HashFunc()
+	h.Write(key)
+	hash := h.Sum(nil)
+	vns, _ := s.local.ListVnodes("")
+	idx := sort.Search(len(vns), func(i int) bool {
+		return bytes.Compare(vns[i].Id, hash) >= 0
+	})
+	return vns[idx%len(vns)]
+}
+
+// Performs lookupCount random key lookups, each from 10 random nodes
+// which must agree on the owner
+func (s *virtualSim) randomKeyLookups(lookupCount int) error {
+	for i := 0; i < lookupCount; i++ {
+		key := []byte(fmt.Sprintf("key-%v", s.rand.Int63()))
+		result := ""
+		for k := 0; k < 10; k++ {
+			vns, err := s.randomRing().Lookup(1, key)
+			if err != nil {
+				return fmt.Errorf("Error during lookup %v: %v", i, err)
+			}
+			if result == "" {
+				result = vns[0].Host
+			} else if result != vns[0].Host {
+				return errors.New("Inconsistent node hashing!")
+			}
+		}
+	}
+	return nil
+}
+
+// Stops all the nodes
+func (s *virtualSim) shutdown() {
+	for _, n := range s.nodes {
+		n.ring.Shutdown()
+	}
+}
+
+// Counts the churn events and the lookups made meanwhile
+type churnStats struct {
+	Joins       int      `json:"joins"`
+	Leaves      int      `json:"leaves"`
+	Crashes     int      `json:"crashes"`
+	Lookups     int      `json:"lookups"`
+	Failed      int      `json:"failed"`     // Lookups returning an error
+	WrongOwner  int      `json:"wrongOwner"` // Lookups returning another vnode than the ideal owner
+	Converged   bool     `json:"converged"`
+	Convergence Duration `json:"convergence"` // Time for the ring to be consistent once churn stopped
+}
+
+// Returns the rate of an event count among the lookups
+func (c *churnStats) rate(count int) float64 {
+	if c.Lookups == 0 {
+		return 0
+	}
+	return float64(count) / float64(c.Lookups)
+}
+
+// Calls f at random times, on average rate times per interval, until
+// the end of the churn
+func (s *virtualSim) every(rate float64, interval time.Duration, end time.Time, f func()) {
+	if rate <= 0 {
+		return
+	}
+	var next func()
+	next = func() {
+		delay := time.Duration(s.rand.ExpFloat64() * float64(interval) / rate)
+		if s.clock.Now().Add(delay).After(end) {
+			return
+		}
+		s.clock.AfterFunc(delay, func() {
+			f()
+			next()
+		})
+	}
+	next()
+}
+
+// Looks up a random key from a random node, checking the owner
+func (s *virtualSim) churnLookup() {
+	key := []byte(fmt.Sprintf("key-%v", s.rand.Int63()))
+	s.churn.Lookups++
+	vns, err := s.randomRing().Lookup(1, key)
+	if err != nil {
+		s.churn.Failed++
+		return
+	}
+	if !bytes.Equal(vns[0].Id, s.idealOwner(key).Id) {
+		s.churn.WrongOwner++
+	}
+}
+
+// Joins a node during the churn
+func (s *virtualSim) churnJoin() {
+	if err := s.addNode(); err != nil {
+		fmt.Printf("Error joining a node: %v\n", err)
+		return
+	}
+	s.churn.Joins++
+}
+
+// Removes a node during the churn, keeping at least two nodes
+func (s *virtualSim) churnRemove(graceful bool) {
+	if len(s.nodes) <= 2 {
+		return
+	}
+
+	// The node may have a call in flight, which must return before the
+	// node stops. Retry once all the calls returned.
+	if s.depth > 0 {
+		retry := s.sleepEnd.Sub(s.clock.Now()) + time.Nanosecond
+		s.clock.AfterFunc(retry, func() { s.churnRemove(graceful) })
+		return
+	}
+	s.removeNode(graceful)
+	if graceful {
+		s.churn.Leaves++
+	} else {
+		s.churn.Crashes++
+	}
+}
+
+// Runs a scenario event
+func (s *virtualSim) runEvent(ev ScenarioEvent) {
+	count := ev.Count
+	if count == 0 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		switch ev.Action {
+		case "join":
+			s.churnJoin()
+		case "leave":
+			s.churnRemove(true)
+		case "crash":
+			s.churnRemove(false)
+		}
+	}
+	switch ev.Action {
+	case "partition":
+		s.faults.Partition(ev.Groups...)
+	case "heal":
+		s.faults.Heal()
+	}
+}
+
+// Joins, leaves and crashes nodes at the scenario rates and times while
+// lookups run. Once the churn and the faults stop, measures how long the
+// ring takes to converge.
+func (s *virtualSim) runChurn() {
+	sc := s.sc
+	duration := sc.churnDuration()
+	end := s.clock.Now().Add(duration)
+	s.every(sc.Churn.JoinRate, time.Minute, end, s.churnJoin)
+	s.every(sc.Churn.LeaveRate, time.Minute, end, func() { s.churnRemove(true) })
+	s.every(sc.Churn.CrashRate, time.Minute, end, func() { s.churnRemove(false) })
+	s.every(sc.Workload.LookupRate, time.Second, end, s.churnLookup)
+	for _, ev := range sc.Events {
+		ev := ev
+		s.clock.AfterFunc(time.Duration(ev.At), func() { s.runEvent(ev) })
+	}
+	s.clock.Advance(duration)
+	s.faults.ClearFaults()
+	s.faults.Heal()
+
+	// Wait for consistent successors and predecessors, fingers take longer
+	step := time.Duration(sc.StabilizeMin)
+	for waited := time.Duration(0); waited <= time.Duration(sc.Settle); waited += step {
+		if violations, _ := ringViolations(s.rings()); len(violations) == 0 {
+			s.churn.Converged = true
+			s.churn.Convergence = Duration(waited)
+			return
+		}
+		s.clock.Advance(step)
+	}
+}
+
+// Returns the violations of the ring, except for the fingers, and the
+// number of stale fingers. Fingers are only fixed one per stabilization,
+// so they lag behind a ring that is otherwise correct.
+func ringViolations(rings []*chord.Ring) (res []chord.Violation, staleFingers int) {
+	for _, v := range chord.CheckRings(rings...) {
+		if v.Type == chord.ViolationFinger {
+			staleFingers++
+		} else {
+			res = append(res, v)
+		}
+	}
+	return res, staleFingers
+}
+
+// Runs a scenario: builds a ring on a virtual clock, lets it settle,
+// optionally churns nodes, then checks the ring invariants and the lookups.
+// Returns the results so far on errors.
+func RunVirtual(sc *Scenario, stats stats.ChordStats) (*Result, error) {
+	start := time.Now()
+	s := newVirtualSim(sc, stats)
+	defer s.shutdown()
+	res := &Result{
+		Config: RunConfig{
+			Mode:       "virtual",
+			Scenario:   sc.Name,
+			Nodes:      sc.Nodes,
+			Vnodes:     sc.Vnodes,
+			Successors: sc.Successors,
+			Seed:       sc.Seed,
+		},
+		Scenario: sc,
+	}
+
+	fmt.Printf("Running scenario %s\n", sc.Name)
+	fmt.Print("Starting ring ")
+	for i := 0; i < sc.Nodes; i++ {
+		if err := s.addNode(); err != nil {
+			return res, fmt.Errorf("Error starting node %v: %v", i, err)
+		}
+		s.clock.Advance(time.Duration(sc.JoinInterval))
+		if i%100 == 0 {
+			fmt.Print(".")
+		}
+	}
+	fmt.Printf("\nCreated %v nodes, waiting %v for the ring to settle\n",
+		sc.Nodes, time.Duration(sc.Settle))
+	for _, f := range sc.Faults {
+		fault, rpcs, err := f.fault()
+		if err != nil {
+			return res, err
+		}
+		s.faults.SetFault(chord.Link{From: f.From, To: f.To}, fault, rpcs...)
+	}
+	s.clock.Advance(time.Duration(sc.Settle))
+
+	if duration := sc.churnDuration(); duration > 0 {
+		fmt.Printf("Churning nodes for %v\n", duration)
+		s.runChurn()
+		c := s.churn
+		res.Churn = &c
+		fmt.Printf("Joins: %v, leaves: %v, crashes: %v, running nodes: %v\n",
+			c.Joins, c.Leaves, c.Crashes, len(s.nodes))
+		fmt.Printf("Lookups: %v, failure rate: %.4f, wrong owner rate: %.4f\n",
+			c.Lookups, c.rate(c.Failed), c.rate(c.WrongOwner))
+		if c.Converged {
+			fmt.Printf("Converged %v after the churn\n", c.Convergence)
+		} else {
+			fmt.Printf("Did not converge within %v after the churn\n", time.Duration(sc.Settle))
+		}
+	}
+	s.faults.ClearFaults()
+	s.faults.Heal()
+	if len(sc.Faults) > 0 {
+		faults := s.faults.Stats()
+		res.Faults = &faults
+		fmt.Printf("Injected faults: %+v\n", faults)
+	}
+
+	violations, staleFingers := ringViolations(s.rings())
+	for _, v := range violations {
+		fmt.Println(v)
+	}
+	fmt.Printf("Found %v ring violations and %v stale fingers\n", len(violations), staleFingers)
+	res.Violations = len(violations)
+	res.StaleFingers = staleFingers
+	if *loadReport {
+		vns, _ := s.local.ListVnodes("")
+		res.Load = reportLoad(vns, s.config("").HashFunc)
+	}
+	if err := s.randomKeyLookups(sc.Workload.Lookups); err != nil {
+		return res, err
+	}
+	fmt.Printf("Simulated %v in %v with seed %v\n",
+		s.clock.Now().Sub(time.Unix(0, 0)), time.Since(start), sc.Seed)
+	return res, nil
+}
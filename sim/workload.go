@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"go-chord"
+	"go-chord/stats"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A lookup workload run by concurrent clients against a running ring
+type Workload struct {
+	Clients     int           // Number of concurrent clients
+	Rate        float64       // Target lookups per second over all the clients, 0 for as fast as possible
+	Duration    time.Duration // How long the clients run
+	Keys        string        // Key distribution: "uniform", "zipf" or "hot"
+	KeySpace    int           // Number of distinct keys
+	ZipfS       float64       // Skew of the "zipf" distribution, above 1
+	HotKeys     int           // Number of hot keys of the "hot" distribution
+	HotFraction float64       // Fraction of the "hot" lookups going to the hot keys
+	Seed        int64         // Seed of the key and node choices
+}
+
+// Checks the workload settings
+func (w *Workload) validate() error {
+	if w.Clients < 1 || w.KeySpace < 1 || w.Rate < 0 {
+		return fmt.Errorf("Need at least one client and key, and a positive rate")
+	}
+	switch w.Keys {
+	case "uniform":
+	case "zipf":
+		if w.ZipfS <= 1 {
+			return fmt.Errorf("Zipf skew must be above 1, got %v", w.ZipfS)
+		}
+	case "hot":
+		if w.HotKeys < 1 || w.HotKeys > w.KeySpace || w.HotFraction < 0 || w.HotFraction > 1 {
+			return fmt.Errorf("Need 1 to %v hot keys and a hot fraction in [0,1]", w.KeySpace)
+		}
+	default:
+		return fmt.Errorf("Unknown key distribution %q", w.Keys)
+	}
+	return nil
+}
+
+// Returns a function drawing key indexes in [0,KeySpace) from the
+// distribution, using r
+func (w *Workload) keyChooser(r *rand.Rand) func() int {
+	switch w.Keys {
+	case "zipf":
+		z := rand.NewZipf(r, w.ZipfS, 1, uint64(w.KeySpace-1))
+		return func() int { return int(z.Uint64()) }
+	case "hot":
+		return func() int {
+			if r.Float64() < w.HotFraction {
+				return r.Intn(w.HotKeys)
+			}
+			return r.Intn(w.KeySpace)
+		}
+	default:
+		return func() int { return r.Intn(w.KeySpace) }
+	}
+}
+
+// Outcome of a workload
+type WorkloadResult struct {
+	Keys       string             `json:"keys"`
+	Clients    int                `json:"clients"`
+	TargetRate float64            `json:"targetRate"` // Lookups per second, 0 for as fast as possible
+	Duration   Duration           `json:"duration"`   // Time the clients actually ran
+	Lookups    int                `json:"lookups"`
+	Errors     int                `json:"errors"`
+	Throughput float64            `json:"throughput"` // Completed lookups per second
+	LatencyMs  stats.Distribution `json:"latencyMs"`  // Lookup latency seen by the clients
+}
+
+// Runs the workload: each client looks up keys from random rings,
+// spacing its lookups to reach the target rate together. Lookups are not
+// sent faster to catch up when the ring is slower than the target.
+func RunWorkload(w *Workload, rings []*chord.Ring) (*WorkloadResult, error) {
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	var interval time.Duration
+	if w.Rate > 0 {
+		interval = time.Duration(float64(w.Clients) / w.Rate * float64(time.Second))
+	}
+
+	var lock sync.Mutex
+	var latencies []float64
+	errors := 0
+	var wg sync.WaitGroup
+	start := time.Now()
+	end := start.Add(w.Duration)
+	for i := 0; i < w.Clients; i++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			nextKey := w.keyChooser(r)
+			var local []float64
+			failed := 0
+			next := time.Now()
+			for now := next; now.Before(end); now = time.Now() {
+				if now.Before(next) {
+					time.Sleep(next.Sub(now))
+				}
+				next = next.Add(interval)
+				if next.Before(time.Now()) {
+					next = time.Now()
+				}
+
+				key := []byte(fmt.Sprintf("key-%v", nextKey()))
+				ring := rings[r.Intn(len(rings))]
+				sent := time.Now()
+				if _, err := ring.Lookup(1, key); err != nil {
+					failed++
+					continue
+				}
+				local = append(local, time.Since(sent).Seconds()*1000)
+			}
+			lock.Lock()
+			latencies = append(latencies, local...)
+			errors += failed
+			lock.Unlock()
+		}(rand.New(rand.NewSource(w.Seed + int64(i))))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	return &WorkloadResult{
+		Keys:       w.Keys,
+		Clients:    w.Clients,
+		TargetRate: w.Rate,
+		Duration:   Duration(elapsed),
+		Lookups:    len(latencies) + errors,
+		Errors:     errors,
+		Throughput: float64(len(latencies)) / elapsed.Seconds(),
+		LatencyMs:  stats.NewDistribution(latencies),
+	}, nil
+}
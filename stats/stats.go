@@ -2,6 +2,9 @@ package stats
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -17,8 +20,17 @@ type ChordStats interface {
 	// Track successful cache results
 	SuccessfulCacheResult()
 
+	// Track cache results rejected because the owner could not be verified
+	RejectedCacheResult()
+
 	// Track how many lookups are performed
 	LookupCountIncr()
+
+	// Track vnodes that lost all their successors and found no peer
+	VnodeIsolated()
+
+	// Track isolated vnodes that found their successors again
+	VnodeRecovered()
 }
 
 // Drop all statistics
@@ -30,16 +42,26 @@ func (t *BlackholeStats) LookupTime(duration time.Duration) {}
 
 func (t *BlackholeStats) SuccessfulCacheResult() {}
 
+func (t *BlackholeStats) RejectedCacheResult() {}
+
 func (t *BlackholeStats) LookupCountIncr() {}
 
+func (t *BlackholeStats) VnodeIsolated() {}
+
+func (t *BlackholeStats) VnodeRecovered() {}
+
 var _ ChordStats = ChordStats(&BlackholeStats{})
 
-// Just print the stats to the console
+// Just print the stats to the console. Safe for concurrent lookups.
 type PrintStats struct {
+	lock                   sync.Mutex
 	LookupNumberOfJumpsArr []int
 	LookupTimeArr          []time.Duration
 	SuccessfulCacheResults int
+	RejectedCacheResults   int
 	LookupCount            int
+	IsolatedVnodes         int
+	RecoveredVnodes        int
 }
 
 func NewPrintStats() *PrintStats {
@@ -47,49 +69,147 @@ func NewPrintStats() *PrintStats {
 		LookupNumberOfJumpsArr: make([]int, 0),
 		LookupTimeArr:          make([]time.Duration, 0),
 		SuccessfulCacheResults: 0,
+		RejectedCacheResults:   0,
 		LookupCount:            0,
+		IsolatedVnodes:         0,
+		RecoveredVnodes:        0,
 	}
 }
 
 func (t *PrintStats) LookupNumberOfJumps(n int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.LookupNumberOfJumpsArr = append(t.LookupNumberOfJumpsArr, n)
 }
 
 func (t *PrintStats) LookupTime(duration time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.LookupTimeArr = append(t.LookupTimeArr, duration)
 }
 
 func (t *PrintStats) SuccessfulCacheResult() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.SuccessfulCacheResults++
 }
 
+func (t *PrintStats) RejectedCacheResult() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.RejectedCacheResults++
+}
+
 func (t *PrintStats) LookupCountIncr() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.LookupCount++
 }
 
+func (t *PrintStats) VnodeIsolated() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.IsolatedVnodes++
+}
+
+func (t *PrintStats) VnodeRecovered() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.RecoveredVnodes++
+}
+
 func (t *PrintStats) Print() {
+	s := t.Summary()
+	fmt.Printf("\n\nNumber of jumps: ")
+	fmt.Printf("\nMin: %v", s.Jumps.Min)
+	fmt.Printf("\nMax: %v", s.Jumps.Max)
+	fmt.Printf("\nAvg: %v", s.Jumps.Avg)
+	fmt.Printf("\nCache hits: %v", s.CacheHits)
+	fmt.Printf("\nCache rejections: %v", s.CacheRejections)
+	fmt.Printf("\nLookups: %v", s.Lookups)
+	fmt.Printf("\nIsolated vnodes: %v", s.IsolatedVnodes)
+	fmt.Printf("\nRecovered vnodes: %v", s.RecoveredVnodes)
+	fmt.Printf("\n\nLookup time (milliseconds): ")
+	fmt.Printf("\nMin: %v", s.LookupTimeMs.Min)
+	fmt.Printf("\nMax: %v", s.LookupTimeMs.Max)
+	fmt.Printf("\nAvg: %v", s.LookupTimeMs.Avg)
+}
+
+// Summary of the collected stats, for machine-readable output
+type Summary struct {
+	Lookups         int          `json:"lookups"`
+	CacheHits       int          `json:"cacheHits"`
+	CacheRejections int          `json:"cacheRejections"`
+	CacheHitRate    float64      `json:"cacheHitRate"` // Cache hits per lookup
+	IsolatedVnodes  int          `json:"isolatedVnodes"`
+	RecoveredVnodes int          `json:"recoveredVnodes"`
+	JumpCounts      []int        `json:"jumpCounts"` // Number of lookups per number of jumps
+	Jumps           Distribution `json:"jumps"`
+	LookupTimeMs    Distribution `json:"lookupTimeMs"`
+}
+
+// Summarizes a set of measures
+type Distribution struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// Summarizes the data, all zero if there is none
+func NewDistribution(data []float64) Distribution {
+	sorted := append([]float64(nil), data...)
+	sort.Float64s(sorted)
+	return Distribution{
+		Min: findMin(sorted),
+		Max: findMax(sorted),
+		Avg: findAvg(sorted),
+		P50: findPercentile(sorted, 50),
+		P90: findPercentile(sorted, 90),
+		P99: findPercentile(sorted, 99),
+	}
+}
+
+// Returns the summary of the stats collected so far
+func (t *PrintStats) Summary() Summary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := Summary{
+		Lookups:         t.LookupCount,
+		CacheHits:       t.SuccessfulCacheResults,
+		CacheRejections: t.RejectedCacheResults,
+		IsolatedVnodes:  t.IsolatedVnodes,
+		RecoveredVnodes: t.RecoveredVnodes,
+		JumpCounts:      make([]int, 0),
+	}
+	if t.LookupCount > 0 {
+		s.CacheHitRate = float64(t.SuccessfulCacheResults) / float64(t.LookupCount)
+	}
+
 	numJumps := make([]float64, 0)
 	for _, n := range t.LookupNumberOfJumpsArr {
 		numJumps = append(numJumps, float64(n))
+		for len(s.JumpCounts) <= n {
+			s.JumpCounts = append(s.JumpCounts, 0)
+		}
+		s.JumpCounts[n]++
 	}
-	fmt.Printf("\n\nNumber of jumps: ")
-	fmt.Printf("\nMin: %v", findMin(numJumps))
-	fmt.Printf("\nMax: %v", findMax(numJumps))
-	fmt.Printf("\nAvg: %v", findAvg(numJumps))
-	fmt.Printf("\nCache hits: %v", t.SuccessfulCacheResults)
-	fmt.Printf("\nLookups: %v", t.LookupCount)
+	s.Jumps = NewDistribution(numJumps)
 
 	lookupTime := make([]float64, 0)
 	for _, n := range t.LookupTimeArr {
 		lookupTime = append(lookupTime, n.Seconds()*1000)
 	}
-	fmt.Printf("\n\nLookup time (milliseconds): ")
-	fmt.Printf("\nMin: %v", findMin(lookupTime))
-	fmt.Printf("\nMax: %v", findMax(lookupTime))
-	fmt.Printf("\nAvg: %v", findAvg(lookupTime))
+	s.LookupTimeMs = NewDistribution(lookupTime)
+	return s
 }
 
 func findMin(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
 	min := data[0]
 	for i := 1; i < len(data); i++ {
 		if data[i] < min {
@@ -100,6 +220,9 @@ func findMin(data []float64) float64 {
 }
 
 func findMax(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
 	max := data[0]
 	for i := 1; i < len(data); i++ {
 		if data[i] > max {
@@ -110,6 +233,9 @@ func findMax(data []float64) float64 {
 }
 
 func findAvg(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
 	sum := 0.0
 	for i := 0; i < len(data); i++ {
 		sum += data[i]
@@ -117,4 +243,16 @@ func findAvg(data []float64) float64 {
 	return sum / float64(len(data))
 }
 
+// Returns the nearest-rank percentile p of sorted data
+func findPercentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
 var _ ChordStats = ChordStats(&PrintStats{})
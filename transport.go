@@ -1,8 +1,10 @@
 package chord
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,6 +26,7 @@ type ProbabilityDelay struct {
 type DelayTCPConfig struct {
 	FindSuccessorsDelay uint64
 	RandomDelays        []ProbabilityDelay
+	Seed                int64 // Seed of the random delays
 }
 
 func (c *DelayTCPConfig) MaxPossibleDelay() uint64 {
@@ -48,6 +51,7 @@ type LocalTransport struct {
 	local      map[string]*localRPC
 	FakeTcp    bool
 	config     *DelayTCPConfig
+	randLock   sync.Mutex
 	randSource *rand.Rand
 }
 
@@ -69,12 +73,16 @@ func InitLocalTransportFakeTcp(remote Transport, conf *DelayTCPConfig) Transport
 	}
 
 	local := make(map[string]*localRPC)
-	return &LocalTransport{remote: remote, local: local, FakeTcp: true, config: conf, randSource: rand.New(rand.NewSource(time.Now().Unix()))}
+	var seed int64
+	if conf != nil {
+		seed = conf.Seed
+	}
+	return &LocalTransport{remote: remote, local: local, FakeTcp: true, config: conf, randSource: rand.New(rand.NewSource(seed))}
 }
 
 // Checks for a local vnode
 func (lt *LocalTransport) get(vn *Vnode) (VnodeRPC, bool) {
-	key := vn.String()
+	key := vn.idKey()
 	lt.lock.RLock()
 	defer lt.lock.RUnlock()
 	w, ok := lt.local[key]
@@ -98,6 +106,11 @@ func (lt *LocalTransport) ListVnodes(host string) ([]*Vnode, error) {
 		}
 		lt.lock.RUnlock()
 
+		// Sort so the result does not depend on the map order
+		sort.Slice(res, func(i, j int) bool {
+			return bytes.Compare(res[i].Id, res[j].Id) < 0
+		})
+
 		return res, nil
 	}
 
@@ -151,7 +164,9 @@ func (lt *LocalTransport) FindSuccessors(vn *Vnode, n int, key []byte, meta Look
 	if lt.config != nil && len(lt.config.RandomDelays) > 0 {
 
 		// pick a random number in the range [0,1)
+		lt.randLock.Lock()
 		r := lt.randSource.Float64()
+		lt.randLock.Unlock()
 
 		// find the maximum probability that is smaller than rand, use the delay that corresponds to that probability
 		j := -1
@@ -177,6 +192,53 @@ func (lt *LocalTransport) FindSuccessors(vn *Vnode, n int, key []byte, meta Look
 	return lt.remote.FindSuccessors(vn, n, key, meta)
 }
 
+func (lt *LocalTransport) FindSuccessorsMany(vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		return vnodeFindSuccessorsMany(obj, n, keys)
+	}
+
+	// Pass onto remote
+	return findSuccessorsMany(lt.remote, vn, n, keys)
+}
+
+// Finds the successors of many keys through a transport, with a request
+// per key if it cannot batch them
+func findSuccessorsMany(trans Transport, vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	if batch, ok := trans.(BatchTransport); ok {
+		return batch.FindSuccessorsMany(vn, n, keys)
+	}
+	results := make([][]*Vnode, len(keys))
+	for i, key := range keys {
+		_, res, err := trans.FindSuccessors(vn, n, key, NewLookupMetaData())
+		if err != nil {
+			return nil, err
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+// Finds the successors of many keys on a registered vnode, one key at a
+// time if it cannot batch them
+func vnodeFindSuccessorsMany(obj VnodeRPC, n int, keys [][]byte) ([][]*Vnode, error) {
+	if batch, ok := obj.(BatchVnodeRPC); ok {
+		return batch.FindSuccessorsMany(n, keys)
+	}
+	results := make([][]*Vnode, len(keys))
+	for i, key := range keys {
+		_, res, err := obj.FindSuccessors(n, key, NewLookupMetaData())
+		if err != nil {
+			return nil, err
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
 func (lt *LocalTransport) ClearPredecessor(target, self *Vnode) error {
 	// Look for it locally
 	obj, ok := lt.get(target)
@@ -203,9 +265,35 @@ func (lt *LocalTransport) SkipSuccessor(target, self *Vnode) error {
 	return lt.remote.SkipSuccessor(target, self)
 }
 
+func (lt *LocalTransport) Handshake(vn *Vnode, info *ClusterInfo) (*ClusterInfo, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		return obj.Handshake(info)
+	}
+
+	// Pass onto remote
+	return lt.remote.Handshake(vn, info)
+}
+
+func (lt *LocalTransport) LeaveHandover(vn *Vnode, info *LeaveInfo) error {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		return obj.LeaveHandover(info)
+	}
+
+	// Pass onto remote
+	return lt.remote.LeaveHandover(vn, info)
+}
+
 func (lt *LocalTransport) Register(v *Vnode, o VnodeRPC) {
 	// Register local instance
-	key := v.String()
+	key := v.idKey()
 	lt.lock.Lock()
 	lt.host = v.Host
 	lt.local[key] = &localRPC{v, o}
@@ -216,7 +304,7 @@ func (lt *LocalTransport) Register(v *Vnode, o VnodeRPC) {
 }
 
 func (lt *LocalTransport) Deregister(v *Vnode) {
-	key := v.String()
+	key := v.idKey()
 	lt.lock.Lock()
 	delete(lt.local, key)
 	lt.lock.Unlock()
@@ -247,6 +335,10 @@ func (*BlackholeTransport) FindSuccessors(vn *Vnode, n int, key []byte, meta Loo
 	return NewLookupMetaData(), nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
 }
 
+func (*BlackholeTransport) FindSuccessorsMany(vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	return nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
+}
+
 func (*BlackholeTransport) ClearPredecessor(target, self *Vnode) error {
 	return fmt.Errorf("Failed to connect! Blackhole: %s", target.String())
 }
@@ -255,5 +347,13 @@ func (*BlackholeTransport) SkipSuccessor(target, self *Vnode) error {
 	return fmt.Errorf("Failed to connect! Blackhole: %s", target.String())
 }
 
+func (*BlackholeTransport) Handshake(vn *Vnode, info *ClusterInfo) (*ClusterInfo, error) {
+	return nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
+}
+
+func (*BlackholeTransport) LeaveHandover(vn *Vnode, info *LeaveInfo) error {
+	return fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
+}
+
 func (*BlackholeTransport) Register(v *Vnode, o VnodeRPC) {
 }
@@ -13,6 +13,8 @@ type MockVnodeRPC struct {
 	key       []byte
 	succ      []*Vnode
 	skip      *Vnode
+	info      *ClusterInfo
+	leave     *LeaveInfo
 }
 
 func (mv *MockVnodeRPC) GetPredecessor() (*Vnode, error) {
@@ -27,6 +29,14 @@ func (mv *MockVnodeRPC) FindSuccessors(n int, key []byte, meta LookupMetaData) (
 	return meta, mv.succ, mv.err
 }
 
+func (mv *MockVnodeRPC) FindSuccessorsMany(n int, keys [][]byte) ([][]*Vnode, error) {
+	res := make([][]*Vnode, len(keys))
+	for i := range keys {
+		res[i] = mv.succ
+	}
+	return res, mv.err
+}
+
 func (mv *MockVnodeRPC) ClearPredecessor(p *Vnode) error {
 	mv.pred = nil
 	return nil
@@ -37,6 +47,16 @@ func (mv *MockVnodeRPC) SkipSuccessor(s *Vnode) error {
 	return nil
 }
 
+func (mv *MockVnodeRPC) Handshake(info *ClusterInfo) (*ClusterInfo, error) {
+	mv.info = info
+	return info, mv.err
+}
+
+func (mv *MockVnodeRPC) LeaveHandover(info *LeaveInfo) error {
+	mv.leave = info
+	return mv.err
+}
+
 func makeLocal() *LocalTransport {
 	return InitLocalTransport(nil).(*LocalTransport)
 }
@@ -62,7 +82,7 @@ func TestLocalList(t *testing.T) {
 		t.Fatalf("unexpected err. %s", err)
 	}
 	if len(list) != 1 || list[0] != vn {
-		t.Fatalf("local list failed", list)
+		t.Fatalf("local list failed %v", list)
 	}
 }
 
@@ -101,6 +121,18 @@ func TestLocalMissingPing(t *testing.T) {
 	}
 }
 
+func TestLocalPingIDWidth(t *testing.T) {
+	l := makeLocal()
+	l.Register(&Vnode{Id: []byte{2}}, &MockVnodeRPC{})
+
+	// IDs at the same ring position but of another length are not local
+	for _, id := range [][]byte{{0, 2}, {1, 2}} {
+		if res, _ := l.Ping(&Vnode{Id: id}); res {
+			t.Fatalf("ping of %x succeeded", id)
+		}
+	}
+}
+
 func TestLocalGetPredecessor(t *testing.T) {
 	l := makeLocal()
 	pred := &Vnode{Id: []byte{10}}
@@ -181,6 +213,59 @@ func TestLocalFindSucc(t *testing.T) {
 	}
 }
 
+func TestLocalFindSuccMany(t *testing.T) {
+	l := makeLocal()
+	suc := []*Vnode{&Vnode{Id: []byte{40}}}
+
+	mockVN := &MockVnodeRPC{succ: suc, err: nil}
+	vn := &Vnode{Id: []byte{12}}
+	l.Register(vn, mockVN)
+
+	keys := [][]byte{[]byte("test"), []byte("foo")}
+	res, err := l.FindSuccessorsMany(vn, 1, keys)
+	if err != nil {
+		t.Fatalf("local FindSuccessorsMany failed")
+	}
+	if len(res) != 2 || res[0][0] != suc[0] || res[1][0] != suc[0] {
+		t.Fatalf("got wrong successors")
+	}
+
+	unknown := &Vnode{Id: []byte{1}}
+	_, err = l.FindSuccessorsMany(unknown, 1, keys)
+	if err == nil {
+		t.Fatalf("remote find should fail")
+	}
+}
+
+// Hide the batched lookups of a vnode or transport
+type unbatchedVnodeRPC struct{ VnodeRPC }
+type unbatchedTransport struct{ Transport }
+
+func TestLocalFindSuccManyUnbatched(t *testing.T) {
+	l := makeLocal()
+	suc := []*Vnode{&Vnode{Id: []byte{40}}}
+	mockVN := &MockVnodeRPC{succ: suc, err: nil}
+	vn := &Vnode{Id: []byte{12}}
+	l.Register(vn, &unbatchedVnodeRPC{mockVN})
+
+	// Vnodes and transports that cannot batch get a request per key
+	keys := [][]byte{[]byte("test"), []byte("foo")}
+	remote := InitLocalTransport(&unbatchedTransport{l})
+	for _, trans := range []Transport{l, remote} {
+		res, err := findSuccessorsMany(trans, vn, 1, keys)
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		if len(res) != 2 || res[0][0] != suc[0] || res[1][0] != suc[0] {
+			t.Fatalf("got wrong successors")
+		}
+		if string(mockVN.key) != "foo" {
+			t.Fatalf("expected a request for the last key")
+		}
+		mockVN.key = nil
+	}
+}
+
 func TestLocalClearPred(t *testing.T) {
 	l := makeLocal()
 	pred := &Vnode{Id: []byte{10}}
@@ -285,6 +370,15 @@ func TestBHFindSuccessors(t *testing.T) {
 	}
 }
 
+func TestBHFindSuccessorsMany(t *testing.T) {
+	bh := BlackholeTransport{}
+	vn := &Vnode{Id: []byte{12}}
+	_, err := bh.FindSuccessorsMany(vn, 1, [][]byte{[]byte("test")})
+	if err.Error()[:18] != "Failed to connect!" {
+		t.Fatalf("expected fail")
+	}
+}
+
 func TestBHClearPred(t *testing.T) {
 	bh := BlackholeTransport{}
 	vn := &Vnode{Id: []byte{12}}
@@ -3,8 +3,6 @@ package chord
 import (
 	"bytes"
 	"fmt"
-	"math/big"
-	"math/rand"
 	"time"
 )
 
@@ -12,63 +10,23 @@ import (
 func randStabilize(conf *Config) time.Duration {
 	min := conf.StabilizeMin
 	max := conf.StabilizeMax
-	r := rand.Float64()
+	r := conf.randFloat64()
 	return time.Duration((r * float64(max-min)) + float64(min))
 }
 
 // Checks if a key is STRICTLY between two ID's exclusively
 func between(id1, id2, key []byte) bool {
-	// Check for ring wrap around
-	if bytes.Compare(id1, id2) == 1 {
-		return bytes.Compare(id1, key) == -1 ||
-			bytes.Compare(id2, key) == 1
-	}
-
-	// Handle the normal case
-	return bytes.Compare(id1, key) == -1 &&
-		bytes.Compare(id2, key) == 1
+	return IDFromBytes(key).between(IDFromBytes(id1), IDFromBytes(id2))
 }
 
 // Checks if a key is between two ID's, right inclusive
 func betweenRightIncl(id1, id2, key []byte) bool {
-	// Check for ring wrap around
-	if bytes.Compare(id1, id2) == 1 {
-		return bytes.Compare(id1, key) == -1 ||
-			bytes.Compare(id2, key) >= 0
-	}
-
-	return bytes.Compare(id1, key) == -1 &&
-		bytes.Compare(id2, key) >= 0
+	return IDFromBytes(key).betweenRightIncl(IDFromBytes(id1), IDFromBytes(id2))
 }
 
 // Computes the offset by (n + 2^exp) % (2^mod)
 func powerOffset(id []byte, exp int, mod int) []byte {
-	// Copy the existing slice
-	off := make([]byte, len(id))
-	copy(off, id)
-
-	// Convert the ID to a bigint
-	idInt := big.Int{}
-	idInt.SetBytes(id)
-
-	// Get the offset
-	two := big.NewInt(2)
-	offset := big.Int{}
-	offset.Exp(two, big.NewInt(int64(exp)), nil)
-
-	// Sum
-	sum := big.Int{}
-	sum.Add(&idInt, &offset)
-
-	// Get the ceiling
-	ceil := big.Int{}
-	ceil.Exp(two, big.NewInt(int64(mod)), nil)
-
-	// Apply the mod
-	idInt.Mod(&sum, &ceil)
-
-	// Add together
-	return idInt.Bytes()
+	return IDFromBytes(id).Add(powerOfTwo(exp), mod).Bytes(mod)
 }
 
 // max returns the max of two ints
@@ -100,6 +58,20 @@ func nearestVnodeToKey(vnodes []*Vnode, key []byte) *Vnode {
 	return vnodes[len(vnodes)-1]
 }
 
+// Trims the slice to remove nil elements
+func trimSlice(vn []*Vnode) []*Vnode {
+	if vn == nil {
+		return vn
+	}
+
+	// Find a non-nil index
+	idx := len(vn) - 1
+	for idx >= 0 && vn[idx] == nil {
+		idx--
+	}
+	return vn[:idx+1]
+}
+
 // Merges errors together
 func mergeErrors(err1, err2 error) error {
 	if err1 == nil {
@@ -125,3 +97,13 @@ func (self VnodeSortable) Less(i, j int) bool {
 func (self VnodeSortable) Swap(i, j int) {
 	self[i], self[j] = self[j], self[i]
 }
+
+// Checks if a vnode is in a list
+func containsVnode(vns []*Vnode, vn *Vnode) bool {
+	for _, v := range vns {
+		if v != nil && bytes.Equal(v.Id, vn.Id) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package chord
 
 import (
+	"crypto/sha1"
 	"errors"
 	"testing"
 	"time"
@@ -165,3 +166,15 @@ func TestMergeErrors(t *testing.T) {
 		t.Fatalf("bad merge")
 	}
 }
+
+func BenchmarkPowerOffset(b *testing.B) {
+	h := sha1.New()
+	h.Write([]byte("test"))
+	id := h.Sum(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		powerOffset(id, i%160, 160)
+	}
+}
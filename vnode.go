@@ -2,11 +2,9 @@ package chord
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"log"
-	"sort"
-	"time"
+	"sync"
 )
 
 // Converts the ID to string
@@ -21,14 +19,17 @@ func (vn *localVnode) init(idx int) {
 
 	// Set our host
 	vn.Host = vn.ring.config.Hostname
+	vn.Meta = vn.ring.meta
 
 	// Initialize all state
 	vn.successors = make([]*Vnode, vn.ring.config.NumSuccessors)
 	vn.finger = make([]*Vnode, vn.ring.config.hashBits)
 
-	//Init node cache.
-	vn.nodeCache = make(map[string]*Vnode)
-	vn.nodeCache[string(vn.Id)] = &vn.Vnode
+	// Initialize the node cache
+	conf := vn.ring.config
+	if conf.UseCache {
+		vn.nodeCache = newNodeCache(conf.CacheSize, conf.CacheTTL, conf.clock())
+	}
 
 	// Register with the RPC mechanism
 	vn.ring.transport.Register(&vn.Vnode, vn)
@@ -37,35 +38,45 @@ func (vn *localVnode) init(idx int) {
 // Schedules the Vnode to do regular maintenence
 func (vn *localVnode) schedule() {
 	// Setup our stabilize timer
-	vn.timer = time.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	vn.timer = vn.ring.config.clock().AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
 }
 
 // Generates an ID for the node
 func (vn *localVnode) genId(idx uint16) {
-	// Use the hash funciton
+	// Use the hash of the node name and index as the ID
 	conf := vn.ring.config
-	hash := conf.HashFunc()
-	hash.Write([]byte(conf.Hostname))
-	binary.Write(hash, binary.BigEndian, idx)
-
-	// Use the hash as the ID
-	vn.Id = hash.Sum(nil)
+	vn.Id = vnodeID(conf.HashFunc, conf.nodeName(), idx)
 }
 
 // Called to periodically stabilize the vnode
 func (vn *localVnode) stabilize() {
 	// Clear the timer
+	vn.lock.Lock()
 	vn.timer = nil
+	shutdown := vn.shutdown
+	vn.lock.Unlock()
 
 	// Check for shutdown
-	if vn.ring.shutdown != nil {
-		vn.ring.shutdown <- true
+	if shutdown != nil {
+		shutdown <- true
 		return
 	}
 
 	// Setup the next stabilize timer
 	defer vn.schedule()
 
+	// Keep trying to rejoin the ring while isolated
+	if vn.isIsolated() {
+		vn.recoverSuccessors()
+	}
+
+	// Look for another ring to merge with
+	if interval := vn.ring.config.MergeInterval; interval > 0 && vn.ring.config.since(vn.merged) >= interval {
+		vn.mergeRings()
+	}
+
 	// Check for new successor
 	if err := vn.checkNewSuccessor(); err != nil {
 		log.Printf("[ERR] Error checking for new successor: %s", err)
@@ -87,18 +98,20 @@ func (vn *localVnode) stabilize() {
 	}
 
 	// Set the last stabilized time
-	vn.stabilized = time.Now()
+	vn.stabilized = vn.ring.config.clock().Now()
 }
 
 // Checks for a new successor
 func (vn *localVnode) checkNewSuccessor() error {
 	// Ask our successor for it's predecessor
 	trans := vn.ring.transport
+	old := vn.snapshotSuccessors()
+	defer vn.publishSuccessors(old)
 
 CHECK_NEW_SUC:
-	succ := vn.successors[0]
+	succ := vn.firstSuccessor()
 	if succ == nil {
-		panic("Node has no successor!")
+		return vn.recoverSuccessors()
 	}
 	maybe_suc, err := trans.GetPredecessor(succ)
 	if err != nil {
@@ -106,31 +119,35 @@ CHECK_NEW_SUC:
 		known := vn.knownSuccessors()
 		if known > 1 {
 			for i := 0; i < known; i++ {
-				if alive, _ := trans.Ping(vn.successors[0]); !alive {
-					// Don't eliminate the last successor we know of
+				dead := vn.firstSuccessor()
+				if alive, _ := trans.Ping(dead); !alive {
+					// Recover once the last successor we know of is dead
 					if i+1 == known {
-						return fmt.Errorf("All known successors dead!")
+						return vn.recoverSuccessors()
 					}
 
 					// Advance the successors list past the dead one
-					copy(vn.successors[0:], vn.successors[1:])
-					vn.successors[known-1-i] = nil
+					vn.skipSuccessor(dead)
 				} else {
 					// Found live successor, check for new one
 					goto CHECK_NEW_SUC
 				}
 			}
+		} else if alive, _ := trans.Ping(succ); !alive {
+			return vn.recoverSuccessors()
 		}
 		return err
 	}
 
-	// Check if we should replace our successor
-	if maybe_suc != nil && between(vn.Id, succ.Id, maybe_suc.Id) {
+	// Check if we should replace our successor. Any other vnode is
+	// better than ourself.
+	alone := bytes.Equal(succ.Id, vn.Id)
+	if maybe_suc != nil && (between(vn.Id, succ.Id, maybe_suc.Id) ||
+		(alone && !bytes.Equal(maybe_suc.Id, vn.Id))) {
 		// Check if new successor is alive before switching
 		alive, err := trans.Ping(maybe_suc)
 		if alive && err == nil {
-			copy(vn.successors[1:], vn.successors[0:len(vn.successors)-1])
-			vn.successors[0] = maybe_suc
+			vn.prependSuccessor(maybe_suc)
 		} else {
 			return err
 		}
@@ -140,34 +157,86 @@ CHECK_NEW_SUC:
 
 // RPC: Invoked to return out predecessor
 func (vn *localVnode) GetPredecessor() (*Vnode, error) {
-	return vn.predecessor, nil
+	return vn.getPredecessor(), nil
+}
+
+// Returns our predecessor
+func (vn *localVnode) getPredecessor() *Vnode {
+	vn.lock.RLock()
+	defer vn.lock.RUnlock()
+	return vn.predecessor
+}
+
+// Returns our first successor, nil while recovering
+func (vn *localVnode) firstSuccessor() *Vnode {
+	vn.lock.RLock()
+	defer vn.lock.RUnlock()
+	return vn.successors[0]
+}
+
+// Puts a vnode first in the successors list. A vnode alone on the ring
+// replaces itself rather than keeping itself as a later successor.
+func (vn *localVnode) prependSuccessor(s *Vnode) {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if first := vn.successors[0]; first != nil && !bytes.Equal(first.Id, vn.Id) {
+		copy(vn.successors[1:], vn.successors[0:len(vn.successors)-1])
+	}
+	vn.successors[0] = s
+}
+
+// Drops our first successor if it is still the given vnode. Returns
+// true if it was dropped.
+func (vn *localVnode) skipSuccessor(s *Vnode) bool {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if first := vn.successors[0]; first == nil || !bytes.Equal(first.Id, s.Id) {
+		return false
+	}
+	copy(vn.successors[0:], vn.successors[1:])
+	vn.successors[len(vn.successors)-1] = nil
+	return true
 }
 
 // Notifies our successor of us, updates successor list
 func (vn *localVnode) notifySuccessor() error {
 	// Notify successor
-	succ := vn.successors[0]
+	succ := vn.firstSuccessor()
+	if succ == nil {
+		return fmt.Errorf("Node has no successor!")
+	}
 	succ_list, err := vn.ring.transport.Notify(succ, &vn.Vnode)
 	if err != nil {
 		return err
 	}
 
 	// Trim the successors list if too long
+	old := vn.snapshotSuccessors()
+	defer vn.publishSuccessors(old)
 	max_succ := vn.ring.config.NumSuccessors
 	if len(succ_list) > max_succ-1 {
 		succ_list = succ_list[:max_succ-1]
 	}
 
 	// Update local successors list
+	var peers []string
+	vn.lock.Lock()
 	for idx, s := range succ_list {
 		if s == nil {
 			break
 		}
 		// Ensure we don't set ourselves as a successor!
-		if s == nil || s.String() == vn.String() {
+		if s == nil || bytes.Equal(s.Id, vn.Id) {
 			break
 		}
 		vn.successors[idx+1] = s
+		if s.Host != vn.Host {
+			peers = append(peers, s.Host)
+		}
+	}
+	vn.lock.Unlock()
+	for _, host := range peers {
+		vn.ring.rememberPeer(host)
 	}
 	return nil
 }
@@ -175,19 +244,40 @@ func (vn *localVnode) notifySuccessor() error {
 // RPC: Notify is invoked when a Vnode gets notified
 func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
 	// Check if we should update our predecessor
-	if vn.predecessor == nil || between(vn.predecessor.Id, vn.Id, maybe_pred.Id) {
+	old, ok := vn.swapPredecessor(func(old *Vnode) bool {
+		return old == nil || bytes.Equal(old.Id, vn.Id) ||
+			between(old.Id, vn.Id, maybe_pred.Id)
+	}, maybe_pred)
+	if ok {
 		// Inform the delegate
 		conf := vn.ring.config
-		old := vn.predecessor
 		vn.ring.invokeDelegate(func() {
 			conf.Delegate.NewPredecessor(&vn.Vnode, maybe_pred, old)
 		})
-
-		vn.predecessor = maybe_pred
 	}
 
 	// Return our successors list
-	return vn.successors, nil
+	return vn.snapshotSuccessors(), nil
+}
+
+// Replaces our predecessor if the current one passes the check,
+// publishing the change of our owned range. Returns the previous
+// predecessor and whether it was replaced.
+func (vn *localVnode) swapPredecessor(check func(old *Vnode) bool, pred *Vnode) (*Vnode, bool) {
+	vn.lock.Lock()
+	old := vn.predecessor
+	if !check(old) {
+		vn.lock.Unlock()
+		return old, false
+	}
+	vn.predecessor = pred
+	vn.lock.Unlock()
+
+	if !sameVnode(old, pred) {
+		vn.ring.publish(Event{Type: EventPredecessorChanged, Vnode: &vn.Vnode,
+			Old: old, New: pred})
+	}
+	return old, true
 }
 
 // Fixes up the finger table
@@ -204,7 +294,10 @@ func (vn *localVnode) fixFingerTable() error {
 	node := nodes[0]
 
 	// Update the finger table
-	vn.finger[vn.last_finger] = node
+	vn.lock.Lock()
+	first := vn.last_finger
+	changed := !sameVnode(vn.finger[first], node)
+	vn.finger[first] = node
 
 	// Try to skip as many finger entries as possible
 	for {
@@ -216,12 +309,18 @@ func (vn *localVnode) fixFingerTable() error {
 
 		// While the node is the successor, update the finger entries
 		if betweenRightIncl(vn.Id, node.Id, offset) {
+			changed = changed || !sameVnode(vn.finger[next], node)
 			vn.finger[next] = node
 			vn.last_finger = next
 		} else {
 			break
 		}
 	}
+	vn.lock.Unlock()
+	if changed {
+		vn.ring.publish(Event{Type: EventFingerUpdated, Vnode: &vn.Vnode,
+			New: node, FingerFrom: first, FingerTo: vn.last_finger})
+	}
 
 	// Increment to the index to repair
 	if vn.last_finger+1 == hb {
@@ -236,21 +335,21 @@ func (vn *localVnode) fixFingerTable() error {
 // Checks the health of our predecessor
 func (vn *localVnode) checkPredecessor() error {
 	// Check predecessor
-	if vn.predecessor != nil {
-		res, err := vn.ring.transport.Ping(vn.predecessor)
+	if pred := vn.getPredecessor(); pred != nil {
+		res, err := vn.ring.transport.Ping(pred)
 		if err != nil {
 			return err
 		}
 
-		// Predecessor is dead
+		// Predecessor is dead, unless it changed meanwhile
 		if !res {
-			vn.predecessor = nil
+			vn.swapPredecessor(func(old *Vnode) bool { return old == pred }, nil)
 		}
 	}
 	return nil
 }
 
-//Find successor results, used in channels
+// Find successor results, used in channels
 type FindSuccessorsResult struct {
 	Meta  LookupMetaData
 	Nodes []*Vnode
@@ -259,35 +358,26 @@ type FindSuccessorsResult struct {
 
 // Finds next N successors. N must be <= NumSuccessors
 func (vn *localVnode) FindSuccessors(n int, key []byte, meta LookupMetaData) (LookupMetaData, []*Vnode, error) {
-	// Check if we are the immediate predecessor
-	if betweenRightIncl(vn.Id, vn.successors[0].Id, key) {
-		return meta, vn.successors[:n], nil
+	// Cannot route while recovering from lost successors
+	if err := checkNumSuccessors(n); err != nil {
+		return meta, nil, err
+	}
+	succs := vn.snapshotSuccessors()
+	if succs[0] == nil {
+		return meta, nil, fmt.Errorf("Node has no successor!")
 	}
 
-	// Append ourselves to the node path
-	meta.LookupPath = append(meta.LookupPath, &vn.Vnode)
-
-	//Cache lookup function
-	lookupCache := func() FindSuccessorsResult {
-
-		//nodeCache values as a sorted slice
-		cacheNodes := make([]*Vnode, 0)
-		for _, node := range vn.nodeCache {
-			cacheNodes = append(cacheNodes, node)
-		}
-		sort.Sort(VnodeSortable(cacheNodes))
-
-		//Get nearest node in cache
-		cacheNearest := nearestVnodeToKey(cacheNodes, key)
-
-		//Only do something if the cache nearest is not ourselves.
-		if bytes.Compare(cacheNearest.Id, vn.Id) != 0 {
-			meta, res, err := vn.ring.transport.FindSuccessors(cacheNearest, n, key, meta)
-			return FindSuccessorsResult{meta, res, err}
-		}
-		return FindSuccessorsResult{NewLookupMetaData(), nil, fmt.Errorf("No valid cache entry")}
+	// Check if we are the immediate predecessor, or alone
+	self, keyID := vn.ringID(), IDFromBytes(key)
+	succ := succs[0].ringID()
+	if keyID.betweenRightIncl(self, succ) || succ == self {
+		return meta, succs[:min(n, len(succs))], nil
 	}
 
+	// Append ourselves to a copy of the node path, the cache and finger
+	// lookups below share it
+	meta.LookupPath = append(append([]*Vnode(nil), meta.LookupPath...), &vn.Vnode)
+
 	//Finger table + successors list lookup function
 	lookupFinger := func() FindSuccessorsResult {
 		// Try the closest preceeding nodes
@@ -306,16 +396,19 @@ func (vn *localVnode) FindSuccessors(n int, key []byte, meta LookupMetaData) (Lo
 				return FindSuccessorsResult{meta, res, nil}
 			} else {
 				log.Printf("[ERR] Failed to contact %s. Got %s", closest.String(), err)
+				if vn.nodeCache != nil {
+					vn.nodeCache.remove(closest)
+				}
 			}
 		}
 
 		// Determine how many successors we know of
-		successors := vn.knownSuccessors()
+		successors := knownVnodes(succs)
 
 		// Check if the ID is between us and any non-immediate successors
 		for i := 1; i <= successors-n; i++ {
-			if betweenRightIncl(vn.Id, vn.successors[i].Id, key) {
-				remain := vn.successors[i:]
+			if keyID.betweenRightIncl(self, succs[i].ringID()) {
+				remain := succs[i:]
 				if len(remain) > n {
 					remain = remain[:n]
 				}
@@ -328,9 +421,9 @@ func (vn *localVnode) FindSuccessors(n int, key []byte, meta LookupMetaData) (Lo
 	}
 	cacheResultChan := make(chan FindSuccessorsResult, 1)
 	lookupResultChan := make(chan FindSuccessorsResult, 1)
-	if vn.ring.config.UseCache {
+	if vn.nodeCache != nil {
 		go func() {
-			cacheResultChan <- lookupCache()
+			cacheResultChan <- vn.findSuccessorsCache(n, key, meta)
 		}()
 	}
 	go func() {
@@ -356,48 +449,323 @@ loop:
 			break loop
 		}
 	}
-	if finalResult.Err == nil {
+	if finalResult.Err == nil && vn.nodeCache != nil {
 
 		//Update cache
 		for _, node := range finalResult.Nodes {
-			vn.nodeCache[string(node.Id)] = node
+			vn.nodeCache.add(node)
 		}
 	}
 	return finalResult.Meta, finalResult.Nodes, finalResult.Err
 }
 
+// Looks up the next N successors through the cached node nearest to
+// the key, which must be closer to the key than ourselves. The answer is
+// confirmed with the owner, and failing or stale nodes leave the cache.
+func (vn *localVnode) findSuccessorsCache(n int, key []byte, meta LookupMetaData) FindSuccessorsResult {
+	//Get nearest node in cache
+	cacheNearest := vn.nodeCache.nearest(key)
+
+	//Only do something if the cache nearest is closer to the key than ourselves.
+	if cacheNearest == nil || !cacheNearest.ringID().between(vn.ringID(), IDFromBytes(key)) {
+		return FindSuccessorsResult{NewLookupMetaData(), nil, fmt.Errorf("No valid cache entry")}
+	}
+	meta, res, err := vn.ring.transport.FindSuccessors(cacheNearest, n, key, meta)
+	if err != nil {
+		// Invalidate nodes that fail to answer
+		vn.nodeCache.remove(cacheNearest)
+		return FindSuccessorsResult{meta, res, err}
+	}
+
+	// A stale cache entry may produce the wrong owner, confirm
+	// the answer with the owner before accepting it
+	if err := vn.verifyOwner(key, res); err != nil {
+		vn.nodeCache.remove(cacheNearest)
+		if stats := vn.ring.config.Stats; stats != nil {
+			stats.RejectedCacheResult()
+		}
+		return FindSuccessorsResult{meta, nil, err}
+	}
+	return FindSuccessorsResult{meta, res, nil}
+}
+
+// Finds the next N successors for each of the keys. Keys are grouped
+// by the next hop from our finger table, and each hop is sent a single
+// request for all of its keys. Results are in the order of the keys, an
+// empty result means that key could not be resolved.
+func (vn *localVnode) FindSuccessorsMany(n int, keys [][]byte) ([][]*Vnode, error) {
+	// Make sure we have a successor
+	if err := checkNumSuccessors(n); err != nil {
+		return nil, err
+	}
+	succs := vn.snapshotSuccessors()
+	if succs[0] == nil {
+		return nil, fmt.Errorf("Node has no successor!")
+	}
+	results := make([][]*Vnode, len(keys))
+
+	// Group the keys we don't own by the next hop
+	type hopKeys struct {
+		hop  *Vnode
+		idxs []int
+		keys [][]byte
+	}
+	var hops []*hopKeys
+	byHop := make(map[string]*hopKeys)
+	var fallback []int
+	self, succ := vn.ringID(), succs[0].ringID()
+	for i, key := range keys {
+		// Check if we are the immediate predecessor
+		if IDFromBytes(key).betweenRightIncl(self, succ) {
+			results[i] = succs[:min(n, len(succs))]
+			continue
+		}
+
+		// Use the closest preceeding node as the next hop
+		cp := closestPreceedingVnodeIterator{}
+		cp.init(vn, key)
+		next := cp.Next()
+		if next == nil {
+			fallback = append(fallback, i)
+			continue
+		}
+		h, ok := byHop[next.idKey()]
+		if !ok {
+			h = &hopKeys{hop: next}
+			byHop[next.idKey()] = h
+			hops = append(hops, h)
+		}
+		h.idxs = append(h.idxs, i)
+		h.keys = append(h.keys, key)
+	}
+
+	// Send a single request to each hop in parallel
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, h := range hops {
+		wg.Add(1)
+		go func(h *hopKeys) {
+			defer wg.Done()
+			res, err := findSuccessorsMany(vn.ring.transport, h.hop, n, h.keys)
+			if err != nil {
+				log.Printf("[ERR] Failed to contact %s. Got %s", h.hop.String(), err)
+			} else if len(res) != len(h.keys) {
+				log.Printf("[ERR] Got %d results for %d keys from %s", len(res), len(h.keys), h.hop.String())
+			}
+			if err != nil || len(res) != len(h.keys) {
+				lock.Lock()
+				fallback = append(fallback, h.idxs...)
+				lock.Unlock()
+				return
+			}
+			lock.Lock()
+			for j, idx := range h.idxs {
+				if len(res[j]) == 0 {
+					fallback = append(fallback, idx)
+				} else {
+					results[idx] = res[j]
+				}
+			}
+			lock.Unlock()
+		}(h)
+	}
+	wg.Wait()
+
+	// Resolve any remaining keys one at a time, which tries every
+	// preceeding node before giving up
+	for _, idx := range fallback {
+		_, res, err := vn.FindSuccessors(n, keys[idx], NewLookupMetaData())
+		if err != nil {
+			log.Printf("[ERR] Failed to find successors for %x. Got %s", keys[idx], err)
+			continue
+		}
+		results[idx] = res
+	}
+	return results, nil
+}
+
+// Checks the number of successors asked for, which may come from a
+// remote node. Callers return at most the successors they know.
+func checkNumSuccessors(n int) error {
+	if n < 1 {
+		return fmt.Errorf("Need at least one successor! Got %d", n)
+	}
+	return nil
+}
+
+// Verifies that the first node of a lookup result owns the key, by
+// asking it for its predecessor and checking the key falls in between.
+// Owners without a predecessor are not verified.
+func (vn *localVnode) verifyOwner(key []byte, nodes []*Vnode) error {
+	if len(nodes) == 0 || nodes[0] == nil {
+		return fmt.Errorf("No owner to verify")
+	}
+	owner := nodes[0]
+	pred, err := vn.ring.transport.GetPredecessor(owner)
+	if err != nil {
+		return err
+	}
+	// An owner that is joining or lost its predecessor cannot tell what
+	// it owns yet, accept its answer rather than dropping the cache entry
+	if pred == nil {
+		return nil
+	}
+	if !betweenRightIncl(pred.Id, owner.Id, key) {
+		return fmt.Errorf("Owner %s does not own key %x", owner.String(), key)
+	}
+	return nil
+}
+
 // Instructs the vnode to leave
 func (vn *localVnode) leave() error {
 	// Inform the delegate we are leaving
 	conf := vn.ring.config
-	pred := vn.predecessor
-	succ := vn.successors[0]
+	pred := vn.getPredecessor()
+	succs := vn.snapshotSuccessors()
+	succ := succs[0]
 	vn.ring.invokeDelegate(func() {
 		conf.Delegate.Leaving(&vn.Vnode, pred, succ)
 	})
+	vn.ring.publish(Event{Type: EventVnodeLeaving, Vnode: &vn.Vnode,
+		Old: pred, New: succ})
+
+	// Hand our successors to our predecessor, and our predecessor
+	// to our successor. They may be the same vnode.
+	info := &LeaveInfo{Vnode: &vn.Vnode, Predecessor: pred,
+		Successors: trimSlice(succs)}
+	var targets []*Vnode
+	if pred != nil && !bytes.Equal(pred.Id, vn.Id) {
+		targets = append(targets, pred)
+	}
+	if succ != nil && !bytes.Equal(succ.Id, vn.Id) && !sameVnode(succ, pred) {
+		targets = append(targets, succ)
+	}
 
-	// Notify predecessor to advance to their next successor
-	var err error
+	// Wait for the acknowledgements
 	trans := vn.ring.transport
-	if vn.predecessor != nil {
-		err = trans.SkipSuccessor(vn.predecessor, &vn.Vnode)
+	errCh := make(chan error, len(targets))
+	for _, target := range targets {
+		go func(target *Vnode) {
+			err := trans.LeaveHandover(target, info)
+			if err != nil {
+				log.Printf("[ERR] Failed to hand over to %s, falling back. Got %s", target.String(), err)
+				if vn.leaveWithoutHandover(target, pred, succ) == nil {
+					err = nil
+				}
+			}
+			errCh <- err
+		}(target)
 	}
+	timeout := make(chan struct{})
+	if conf.LeaveTimeout > 0 {
+		timer := conf.clock().AfterFunc(conf.LeaveTimeout, func() { close(timeout) })
+		defer timer.Stop()
+	}
+	var err error
+	for range targets {
+		select {
+		case e := <-errCh:
+			err = mergeErrors(err, e)
+		case <-timeout:
+			return mergeErrors(err, fmt.Errorf("Timed out waiting for leave acknowledgements!"))
+		}
+	}
+	return err
+}
 
-	// Notify successor to clear old predecessor
-	err = mergeErrors(err, trans.ClearPredecessor(vn.successors[0], &vn.Vnode))
+// Tells a neighbor we are leaving without handing over our neighbors,
+// for peers that do not support it. Our predecessor skips us, and our
+// successor clears us as its predecessor.
+func (vn *localVnode) leaveWithoutHandover(target, pred, succ *Vnode) error {
+	trans := vn.ring.transport
+	var err error
+	if sameVnode(target, pred) {
+		err = mergeErrors(err, trans.SkipSuccessor(target, &vn.Vnode))
+	}
+	if sameVnode(target, succ) {
+		err = mergeErrors(err, trans.ClearPredecessor(target, &vn.Vnode))
+	}
 	return err
 }
 
+// RPC: Invoked by a leaving neighbor to hand over its neighbors
+func (vn *localVnode) LeaveHandover(info *LeaveInfo) error {
+	conf := vn.ring.config
+	leaving := info.Vnode
+
+	// Adopt the successors of a leaving successor
+	vn.lock.Lock()
+	old := vn.successors[0]
+	prev := append([]*Vnode(nil), vn.successors...)
+	adopt := old != nil && bytes.Equal(old.Id, leaving.Id)
+	if adopt {
+		vn.adoptSuccessors(leaving, info.Successors)
+	}
+	vn.lock.Unlock()
+	if adopt {
+		vn.ring.invokeDelegate(func() {
+			conf.Delegate.SuccessorLeaving(&vn.Vnode, old)
+		})
+		vn.publishSuccessors(prev)
+	}
+
+	// Adopt the predecessor of a leaving predecessor
+	pred := info.Predecessor
+	old, ok := vn.swapPredecessor(func(old *Vnode) bool {
+		return old != nil && bytes.Equal(old.Id, leaving.Id)
+	}, pred)
+	if ok {
+		vn.ring.invokeDelegate(func() {
+			conf.Delegate.PredecessorLeaving(&vn.Vnode, old)
+		})
+		if pred != nil {
+			vn.ring.invokeDelegate(func() {
+				conf.Delegate.NewPredecessor(&vn.Vnode, pred, old)
+			})
+		}
+	}
+	return nil
+}
+
+// Replaces the successors with those of a leaving successor, followed
+// by our remaining successors. Skips the leaving vnode and duplicates,
+// and stops at ourself. Must be called with the lock held.
+func (vn *localVnode) adoptSuccessors(leaving *Vnode, succs []*Vnode) {
+	candidates := append(append([]*Vnode{}, succs...), vn.successors[1:]...)
+	adopted := make([]*Vnode, 0, len(vn.successors))
+	for _, s := range candidates {
+		if len(adopted) == len(vn.successors) || (s != nil && bytes.Equal(s.Id, vn.Id)) {
+			break
+		}
+		if s == nil || bytes.Equal(s.Id, leaving.Id) || containsVnode(adopted, s) {
+			continue
+		}
+		adopted = append(adopted, s)
+	}
+
+	// We are the only vnode left
+	if len(adopted) == 0 {
+		adopted = append(adopted, &vn.Vnode)
+	}
+	for idx := range vn.successors {
+		vn.successors[idx] = nil
+		if idx < len(adopted) {
+			vn.successors[idx] = adopted[idx]
+		}
+	}
+}
+
 // Used to clear our predecessor when a node is leaving
 func (vn *localVnode) ClearPredecessor(p *Vnode) error {
-	if vn.predecessor != nil && vn.predecessor.String() == p.String() {
+	old, ok := vn.swapPredecessor(func(old *Vnode) bool {
+		return old != nil && bytes.Equal(old.Id, p.Id)
+	}, nil)
+	if ok {
 		// Inform the delegate
 		conf := vn.ring.config
-		old := vn.predecessor
 		vn.ring.invokeDelegate(func() {
 			conf.Delegate.PredecessorLeaving(&vn.Vnode, old)
 		})
-		vn.predecessor = nil
 	}
 	return nil
 }
@@ -405,26 +773,29 @@ func (vn *localVnode) ClearPredecessor(p *Vnode) error {
 // Used to skip a successor when a node is leaving
 func (vn *localVnode) SkipSuccessor(s *Vnode) error {
 	// Skip if we have a match
-	if vn.successors[0].String() == s.String() {
+	prev := vn.snapshotSuccessors()
+	if vn.skipSuccessor(s) {
 		// Inform the delegate
 		conf := vn.ring.config
-		old := vn.successors[0]
+		old := prev[0]
 		vn.ring.invokeDelegate(func() {
 			conf.Delegate.SuccessorLeaving(&vn.Vnode, old)
 		})
-
-		known := vn.knownSuccessors()
-		copy(vn.successors[0:], vn.successors[1:])
-		vn.successors[known-1] = nil
+		vn.publishSuccessors(prev)
 	}
 	return nil
 }
 
 // Determine how many successors we know of
-func (vn *localVnode) knownSuccessors() (successors int) {
-	for i := 0; i < len(vn.successors); i++ {
-		if vn.successors[i] != nil {
-			successors = i + 1
+func (vn *localVnode) knownSuccessors() int {
+	return knownVnodes(vn.snapshotSuccessors())
+}
+
+// Returns the length of a list of vnodes up to its last non-nil entry
+func knownVnodes(vns []*Vnode) (known int) {
+	for i := 0; i < len(vns); i++ {
+		if vns[i] != nil {
+			known = i + 1
 		}
 	}
 	return
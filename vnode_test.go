@@ -3,7 +3,10 @@ package chord
 import (
 	"bytes"
 	"crypto/sha1"
+	"fmt"
+	"go-chord/stats"
 	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,7 +18,8 @@ func makeVnode() *localVnode {
 		NumSuccessors: 8,
 		StabilizeMin:  min,
 		StabilizeMax:  max,
-		HashFunc:      sha1.New}
+		HashFunc:      sha1.New,
+		hashBits:      160}
 	trans := InitLocalTransport(nil)
 	ring := &Ring{config: conf, transport: trans}
 	return &localVnode{ring: ring}
@@ -63,10 +67,30 @@ func TestGenId(t *testing.T) {
 	}
 }
 
+func TestGenIdNodeName(t *testing.T) {
+	vn := makeVnode()
+	vn.ring.config.Hostname = "10.0.0.1:8000"
+	vn.genId(0)
+	byHost := vn.Id
+
+	// IDs come from the node name, not the address
+	vn.ring.config.NodeName = "node1"
+	vn.genId(0)
+	byName := vn.Id
+	if bytes.Equal(byHost, byName) {
+		t.Fatalf("expected the node name to be used")
+	}
+	vn.ring.config.Hostname = "10.0.0.2:9000"
+	vn.genId(0)
+	if !bytes.Equal(vn.Id, byName) {
+		t.Fatalf("id changed with the address")
+	}
+}
+
 func TestVnodeStabilizeShutdown(t *testing.T) {
 	vn := makeVnode()
 	vn.schedule()
-	vn.ring.shutdown = make(chan bool, 1)
+	vn.shutdown = make(chan bool, 1)
 	vn.stabilize()
 
 	if vn.timer != nil {
@@ -76,7 +100,7 @@ func TestVnodeStabilizeShutdown(t *testing.T) {
 		t.Fatalf("unexpected time")
 	}
 	select {
-	case <-vn.ring.shutdown:
+	case <-vn.shutdown:
 		return
 	default:
 		t.Fatalf("expected message")
@@ -111,16 +135,18 @@ func TestVnodeKnownSucc(t *testing.T) {
 	}
 }
 
-// Checks panic if no successors
-func TestVnodeCheckNewSuccAlivePanic(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("expected panic!")
-		}
-	}()
+// Checks recovery if no successors
+func TestVnodeCheckNewSuccNone(t *testing.T) {
 	vn1 := makeVnode()
 	vn1.init(1)
-	vn1.checkNewSuccessor()
+	if err := vn1.checkNewSuccessor(); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Alone, so its own successor
+	if vn1.successors[0] != &vn1.Vnode || !vn1.isolated {
+		t.Fatalf("expected isolated vnode!")
+	}
 }
 
 // Checks pinging a live successor with no changes
@@ -154,10 +180,11 @@ func TestVnodeCheckNewSuccDead(t *testing.T) {
 	vn1.successors[0] = &Vnode{Id: []byte{0}}
 
 	if err := vn1.checkNewSuccessor(); err == nil {
-		t.Fatalf("err!", err)
+		t.Fatalf("expected err!")
 	}
 
-	if vn1.successors[0].String() != "00" {
+	// Falls back to itself
+	if vn1.successors[0] != &vn1.Vnode || !vn1.isolated {
 		t.Fatalf("unexpected successor!")
 	}
 }
@@ -209,12 +236,12 @@ func TestVnodeCheckNewSuccAllDeadAlternates(t *testing.T) {
 	(r.transport.(*LocalTransport)).Deregister(&vn3.Vnode)
 
 	// Should get an error
-	if err := vn1.checkNewSuccessor(); err.Error() != "All known successors dead!" {
-		t.Fatalf("unexpected err %s", err)
+	if err := vn1.checkNewSuccessor(); err == nil {
+		t.Fatalf("expected err!")
 	}
 
-	// Should just be vn3
-	if vn1.successors[0] != &vn3.Vnode {
+	// Should fall back to the local vnodes
+	if vn1.successors[0] != &r.vnodes[1].Vnode || !vn1.isolated {
 		t.Fatalf("unexpected successor!")
 	}
 }
@@ -675,10 +702,270 @@ func TestVnodeLeave(t *testing.T) {
 		t.Fatalf("unexpected err")
 	}
 
+	// The predecessor gets the full successor list
 	if r.vnodes[4].successors[0] != &r.vnodes[1].Vnode {
 		t.Fatalf("unexpected suc!")
 	}
-	if r.vnodes[1].predecessor != nil {
+	if r.vnodes[4].successors[1] != &r.vnodes[2].Vnode {
+		t.Fatalf("unexpected second suc!")
+	}
+
+	// The successor gets the new predecessor
+	if r.vnodes[1].predecessor != &r.vnodes[4].Vnode {
 		t.Fatalf("unexpected pred!")
 	}
 }
+
+func TestVnodeLeaveLastNeighbor(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn1.predecessor = &vn2.Vnode
+	vn1.successors[0] = &vn2.Vnode
+	vn2.predecessor = &vn1.Vnode
+	vn2.successors[0] = &vn1.Vnode
+
+	// The remaining vnode is alone
+	if err := vn1.leave(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn2.successors[0] != &vn2.Vnode || vn2.knownSuccessors() != 1 {
+		t.Fatalf("unexpected suc!")
+	}
+	if vn2.predecessor != &vn2.Vnode {
+		t.Fatalf("unexpected pred!")
+	}
+}
+
+// Never acknowledges a leave
+type stuckLeaveRPC struct {
+	MockVnodeRPC
+	release chan struct{}
+}
+
+func (s *stuckLeaveRPC) LeaveHandover(info *LeaveInfo) error {
+	<-s.release
+	return nil
+}
+
+func TestVnodeLeaveTimeout(t *testing.T) {
+	r := makeRing()
+	r.config.LeaveTimeout = 10 * time.Millisecond
+	vn := r.vnodes[0]
+
+	stuck := &Vnode{Id: []byte{1}, Host: "stuck"}
+	rpc := &stuckLeaveRPC{release: make(chan struct{})}
+	defer close(rpc.release)
+	r.transport.Register(stuck, rpc)
+	vn.predecessor = stuck
+	vn.successors[0] = &r.vnodes[1].Vnode
+
+	if err := vn.leave(); err == nil {
+		t.Fatalf("expected timeout err!")
+	}
+}
+
+// Lacks the leave handover RPC
+type oldLeaveRPC struct {
+	MockVnodeRPC
+}
+
+func (o *oldLeaveRPC) LeaveHandover(info *LeaveInfo) error {
+	return fmt.Errorf("Unknown request type!")
+}
+
+func TestVnodeLeaveFallback(t *testing.T) {
+	r := makeRing()
+	vn := r.vnodes[0]
+
+	old := &Vnode{Id: []byte{1}, Host: "old"}
+	rpc := &oldLeaveRPC{}
+	rpc.pred = &vn.Vnode
+	r.transport.Register(old, rpc)
+	vn.predecessor = old
+	vn.successors[0] = old
+
+	// The neighbor still learns we left through the older RPCs
+	if err := vn.leave(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if rpc.skip != &vn.Vnode || rpc.pred != nil {
+		t.Fatalf("expected the neighbor to skip and clear us")
+	}
+}
+
+func TestVnodeVerifyOwner(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+
+	// No predecessor, accepted unverified
+	if err := vn1.verifyOwner(vn2.Id, []*Vnode{&vn2.Vnode}); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Key is owned by vn2
+	vn2.predecessor = &vn1.Vnode
+	if err := vn1.verifyOwner(vn2.Id, []*Vnode{&vn2.Vnode}); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Key is owned by vn3, not vn2
+	if err := vn1.verifyOwner(vn3.Id, []*Vnode{&vn2.Vnode}); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if err := vn1.verifyOwner(vn3.Id, nil); err == nil {
+		t.Fatalf("expected err!")
+	}
+}
+
+type rejectStats struct {
+	stats.BlackholeStats
+	rejected int32
+}
+
+func (s *rejectStats) RejectedCacheResult() {
+	atomic.AddInt32(&s.rejected, 1)
+}
+
+// A stale cache entry returning the wrong owner must be rejected
+func TestVnodeFindSuccessorsCacheReject(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	st := &rejectStats{}
+	r.config.Stats = st
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+		r.vnodes[i].predecessor = &r.vnodes[(i+num-1)%num].Vnode
+	}
+
+	// vn3 has a stale successor, skipping vn4
+	vn1 := r.vnodes[0]
+	vn3 := r.vnodes[2]
+	vn4 := r.vnodes[3]
+	vn3.successors[0] = &r.vnodes[4].Vnode
+
+	vn1.nodeCache = newNodeCache(0, 0, wallClock{})
+	vn1.nodeCache.add(&vn3.Vnode)
+	if res := vn1.findSuccessorsCache(1, vn4.Id, NewLookupMetaData()); res.Err == nil {
+		t.Fatalf("expected err!")
+	}
+	if atomic.LoadInt32(&st.rejected) != 1 {
+		t.Fatalf("expected a rejected cache result")
+	}
+	if _, found := vn1.nodeCache.search(vn3.Id); found {
+		t.Fatalf("expected stale node to be invalidated")
+	}
+}
+
+// An owner without a predecessor yet must not reject the cached answer
+func TestVnodeFindSuccessorsCacheNoPredecessor(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	st := &rejectStats{}
+	r.config.Stats = st
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+	}
+
+	vn1 := r.vnodes[0]
+	vn3 := r.vnodes[2]
+	vn4 := r.vnodes[3]
+	vn1.nodeCache = newNodeCache(0, 0, wallClock{})
+	vn1.nodeCache.add(&vn3.Vnode)
+	res := vn1.findSuccessorsCache(1, vn4.Id, NewLookupMetaData())
+	if res.Err != nil {
+		t.Fatalf("unexpected err %s", res.Err)
+	}
+	if len(res.Nodes) != 1 || !sameVnode(res.Nodes[0], &vn4.Vnode) {
+		t.Fatalf("bad result %v", res.Nodes)
+	}
+	if atomic.LoadInt32(&st.rejected) != 0 {
+		t.Fatalf("unexpected rejected cache result")
+	}
+	if _, found := vn1.nodeCache.search(vn3.Id); !found {
+		t.Fatalf("expected node to stay cached")
+	}
+}
+
+func BenchmarkVnodeFindSuccessors(b *testing.B) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+		r.vnodes[i].successors[1] = &r.vnodes[(i+2)%num].Vnode
+	}
+
+	h := r.config.HashFunc()
+	h.Write([]byte("test"))
+	key := h.Sum(nil)
+	vn := r.vnodes[0]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vn.FindSuccessors(1, key, NewLookupMetaData())
+	}
+}
+
+func TestVnodeFindSuccessorsMany(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+		r.vnodes[i].successors[1] = &r.vnodes[(i+2)%num].Vnode
+	}
+
+	// Hash a few keys
+	var keys [][]byte
+	for _, k := range []string{"test", "foo", "bar", "baz", "quux"} {
+		h := r.config.HashFunc()
+		h.Write([]byte(k))
+		keys = append(keys, h.Sum(nil))
+	}
+
+	// Results should match the local ring
+	for i := 0; i < num; i++ {
+		res, err := r.vnodes[i].FindSuccessorsMany(1, keys)
+		if err != nil {
+			t.Fatalf("unexpected err! %s", err)
+		}
+		for j, key := range keys {
+			exp := r.nearestVnode(key).successors[0]
+			if len(res[j]) != 1 || res[j][0] != exp {
+				t.Fatalf("unexpected succ! K:%x Exp: %s Got:%v",
+					key, exp, res[j])
+			}
+		}
+	}
+
+	// At least one successor must be asked for, more than known are
+	// limited to the known ones
+	if _, err := r.vnodes[0].FindSuccessorsMany(0, keys); err == nil {
+		t.Fatalf("expected err!")
+	}
+	res, err := r.vnodes[0].FindSuccessorsMany(100, keys)
+	if err != nil {
+		t.Fatalf("unexpected err! %s", err)
+	}
+	for _, succs := range res {
+		if len(succs) == 0 || len(succs) > len(r.vnodes[0].successors) {
+			t.Fatalf("bad successors %v", succs)
+		}
+	}
+
+	// Without a successor nothing can be routed
+	vn := &localVnode{}
+	vn.successors = make([]*Vnode, 1)
+	if _, err := vn.FindSuccessorsMany(1, keys); err == nil {
+		t.Fatalf("expected err!")
+	}
+}